@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	kubeApiV1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -33,23 +34,171 @@ const (
 	PhaseFailed ObjectPhase = "Failed"
 	// PhaseDestroying means that the sql resource are being destroying
 	PhaseDestroying ObjectPhase = "Destroying"
+	// PhaseAwaitingApproval means that the sql resource plan must be approved before being applied
+	PhaseAwaitingApproval ObjectPhase = "AwaitingApproval"
+)
+
+type DeletionPolicy string
+
+const (
+	// DeletionDelete means that the cloud resources are destroyed with the PostgreSql
+	DeletionDelete DeletionPolicy = "Delete"
+	// DeletionRetain means that the cloud resources and their state are left behind
+	DeletionRetain DeletionPolicy = "Retain"
+	// DeletionOrphan means that the cloud resources are left behind and their state is exported
+	DeletionOrphan DeletionPolicy = "Orphan"
+)
+
+type BackendType string
+
+const (
+	// BackendGCS stores the terraform states in a GCS bucket provisioned by terrak8s
+	BackendGCS BackendType = "gcs"
+	// BackendKubernetes stores the terraform states in Secrets of the PostgreSql namespace
+	BackendKubernetes BackendType = "kubernetes"
+	// BackendHTTP stores the terraform states through the http backend served by the manager
+	BackendHTTP BackendType = "http"
+	// BackendS3 stores the terraform states in an S3 compatible store
+	BackendS3 BackendType = "s3"
+)
+
+type AuthMode string
+
+const (
+	// AuthServiceAccountKey authenticates terraform with the serviceAccount json key of a Secret
+	AuthServiceAccountKey AuthMode = "ServiceAccountKey"
+	// AuthWorkloadIdentity authenticates terraform with the ambient credentials of the pod running it, e.g. the
+	// GCP service account bound to its Kubernetes service account by Workload Identity
+	AuthWorkloadIdentity AuthMode = "WorkloadIdentity"
+)
+
+type StageName string
+
+const (
+	// StageBucket provisions the storage bucket holding the terraform state
+	StageBucket StageName = "Bucket"
+	// StageBackend initializes the remote backend of the sql instance
+	StageBackend StageName = "Backend"
+	// StageInstance plans and applies the sql instance
+	StageInstance StageName = "Instance"
+	// StageOutput reads the terraform outputs of the sql instance
+	StageOutput StageName = "Output"
+	// StageDriftCheck compares the sql instance with its spec
+	StageDriftCheck StageName = "DriftCheck"
+)
+
+type StageStatus string
+
+const (
+	// StageInProgress means that the stage is running, or has been interrupted
+	StageInProgress StageStatus = "InProgress"
+	// StageCompleted means that the stage succeeded with its input hash
+	StageCompleted StageStatus = "Completed"
+	// StageFailed means that the stage failed, it is retried first
+	StageFailed StageStatus = "Failed"
+)
+
+type ApprovalMode string
+
+const (
+	// ApprovalAutomatic means that every plan is applied without approval
+	ApprovalAutomatic ApprovalMode = "Automatic"
+	// ApprovalManual means that plans destroying or replacing resources must be approved
+	ApprovalManual ApprovalMode = "Manual"
+)
+
+type DriftPolicy string
+
+const (
+	// DriftReport means that drifts are only reported through the Drifted condition
+	DriftReport DriftPolicy = "Report"
+	// DriftCorrect means that drifts are reported and corrected by applying the configuration again
+	DriftCorrect DriftPolicy = "Correct"
+)
+
+type ConditionType string
+
+const (
+	// ConditionDrifted means that the cloud resources differ from the PostgreSql spec
+	ConditionDrifted ConditionType = "Drifted"
+	// ConditionStateLocked means that the terraform state is locked by another run
+	ConditionStateLocked ConditionType = "StateLocked"
+	// ConditionFailed means that the last terraform run failed, its reason tells how it is retried
+	ConditionFailed ConditionType = "Failed"
+	// ConditionProviderConfigNotFound means that the ProviderConfig referenced by the PostgreSql cannot be read
+	ConditionProviderConfigNotFound ConditionType = "ProviderConfigNotFound"
+	// ConditionDeprecatedCredentials means that the GCP credentials are read from the json keys of the namespace
+	ConditionDeprecatedCredentials ConditionType = "DeprecatedCredentials"
+	// ConditionStateSecretConflict means that the state Secret of the http backend exists without being owned by the PostgreSql
+	ConditionStateSecretConflict ConditionType = "StateSecretConflict"
+)
+
+const (
+	// AnnotationPrefix is the prefix of the annotations handled by terrak8s
+	AnnotationPrefix = "sql.terrak8s.io/"
+	// ApprovePlanAnnotation approves the plan whose hash is the annotation value
+	ApprovePlanAnnotation = AnnotationPrefix + "approve-plan"
+	// ForceUnlockAnnotation force-unlocks the terraform state lock whose ID is the annotation value
+	ForceUnlockAnnotation = AnnotationPrefix + "force-unlock"
+	// DefaultRetainedStateVersions is the number of noncurrent versions of a terraform state retained by the state bucket
+	DefaultRetainedStateVersions = 10
+	// ConfirmDeleteAnnotation confirms the deletion of a PostgreSql protected by deletionProtection, its value
+	// must be the name of the cloud sql instance
+	ConfirmDeleteAnnotation = AnnotationPrefix + "confirm-delete"
+	// ReconcileAnnotation runs every terraform stage again whenever its value changes, e.g. to a timestamp
+	ReconcileAnnotation = AnnotationPrefix + "reconcile"
+	// MigrateStateAnnotation confirms the migration of the terraform state to a new remoteState, its value
+	// must be the type of the new backend
+	MigrateStateAnnotation = AnnotationPrefix + "migrate-state"
+	// AbandonAnnotation confirms that a PostgreSql being deleted while its ProviderConfig is not found leaves
+	// its cloud resources behind, its value must be the name of the cloud sql instance
+	AbandonAnnotation = AnnotationPrefix + "abandon"
 )
 
 // PostgreSqlSpec defines the desired state of PostgreSql
 type PostgreSqlSpec struct {
-	Project     PostgresqlInstanceProvider `json:"project"`
-	RemoteState PostgresqlInstanceBackend  `json:"remoteState"`
+	//ProviderConfigRef reference the ProviderConfig completing project, remoteState and bucketConfig, the fields
+	//set in the PostgreSql override the ones of the ProviderConfig
+	// +optional
+	ProviderConfigRef *ProviderConfigReference `json:"providerConfigRef,omitempty"`
+	// +optional
+	Project PostgresqlInstanceProvider `json:"project,omitempty"`
+	// +optional
+	RemoteState PostgresqlInstanceBackend `json:"remoteState,omitempty"`
 	// +optional
 	BucketConfig PostgresqlInstanceStorageBucket `json:"bucketConfig"`
 	SqlInstance  PostgresqlInstanceSpec          `json:"sqlInstance"`
 	Databases    []PostgresInstanceDatabases     `json:"databases"`
 	Users        []PostgresInstanceDatabaseUsers `json:"users,omitempty"`
+	//ApprovalMode define whether plans destroying or replacing resources must be approved
+	//through the sql.terrak8s.io/approve-plan annotation before being applied
+	// +kubebuilder:validation:Enum=Automatic;Manual
+	// +optional
+	ApprovalMode ApprovalMode `json:"approvalMode,omitempty"`
+	//DriftPolicy define whether drifts of the cloud resources are only reported or corrected
+	// +kubebuilder:validation:Enum=Report;Correct
+	// +optional
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+	//DeletionPolicy define what happens to the cloud resources once the PostgreSql is deleted
+	// +kubebuilder:validation:Enum=Delete;Retain;Orphan
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	//DriftCheckInterval define the period between two drift checks, the operator default is used when empty.
+	//Drift checks are disabled with a zero interval
+	// +optional
+	DriftCheckInterval *metav1.Duration `json:"driftCheckInterval,omitempty"`
+	//Adopt imports the existing cloud sql instance, databases and users named in the spec instead of creating them.
+	//The plan following the import must be approved before anything is applied
+	// +optional
+	Adopt bool `json:"adopt,omitempty"`
 }
 
 //PostgresqlInstanceSpec define the sql instance
 type PostgresqlInstanceSpec struct {
 	//DataBaseVersion define the PostgreSQL version to use
 	DataBaseVersion string `json:"databaseVersion" tf:"database_version"`
+	//DeletionProtection prevents the deletion of the cloud sql instance, and of the PostgreSql until its
+	//deletion is confirmed with the confirm-delete annotation
 	// +optional
 	DeletionProtection bool `json:"deletionProtection" tf:"deletion_protection"`
 	//The name of the Cloud SQL instance
@@ -67,22 +216,105 @@ type PostgresqlInstanceSpec struct {
 
 //PostgresqlInstanceProvider define information about gcp tenant
 type PostgresqlInstanceProvider struct {
-	//Name define the project name
-	Name string `json:"name" tf:"project"`
+	//Name define the project name, it is required unless it is set by the ProviderConfig
+	// +optional
+	Name string `json:"name,omitempty" tf:"project"`
 	// Region the instance will sit in
 	// +optional
 	Region string `json:"region" tf:"region"`
 	// Zone define the preferred compute engine zone.
 	// +optional
 	Zone string `json:"zone" tf:"zone"`
+	//AuthMode define how terraform authenticates against GCP, with the serviceAccount json key of credentials or
+	//with the ambient credentials of the operator, without any key
+	// +kubebuilder:validation:Enum=ServiceAccountKey;WorkloadIdentity
+	// +optional
+	AuthMode AuthMode `json:"authMode,omitempty" tf:"-"`
+	//Credentials define the GCP service account key used by terraform. When empty, the json keys of every
+	//Secret of the namespace are used, which is deprecated
+	// +optional
+	Credentials *PostgresqlInstanceCredentials `json:"credentials,omitempty" tf:"-"`
+	//ImpersonateServiceAccount is the email of the GCP service account the google provider impersonates, the
+	//authenticated identity must be granted roles/iam.serviceAccountTokenCreator on it
+	// +optional
+	ImpersonateServiceAccount string `json:"impersonateServiceAccount,omitempty" tf:"impersonate_service_account,omitempty"`
+	//ProviderVersion define the version of the google provider rendered by terrak8s, 3.40.0 by default
+	// +optional
+	ProviderVersion string `json:"providerVersion,omitempty" tf:"-"`
+}
+
+//GetAuthMode return the authentication mode of terraform, ServiceAccountKey when empty
+func (in PostgresqlInstanceProvider) GetAuthMode() AuthMode {
+	if in.AuthMode == "" {
+		return AuthServiceAccountKey
+	}
+	return in.AuthMode
+}
+
+//PostgresqlInstanceCredentials define the credentials of the google provider
+type PostgresqlInstanceCredentials struct {
+	//SecretKeyRef selects the key of a secret in the PostgreSql namespace holding a GCP service account json key
+	SecretKeyRef PostgresInstanceDatabasePasswordSpec `json:"secretKeyRef"`
 }
 
-//PostgresqlInstanceBackend define gcp bucket config
+//PostgresqlInstanceBackend define the terraform backend holding the states
 type PostgresqlInstanceBackend struct {
-	//BucketName define the name of the GCS bucket
-	BucketName string `json:"bucketName" tf:"bucket"`
+	//Type define the terraform backend, gcs stores the states in the bucketName GCS bucket, kubernetes
+	//stores them in Secrets of the PostgreSql namespace without any bucket, http stores them through the
+	//manager in a Secret owned by the PostgreSql, s3 stores them in the s3 bucket
+	// +kubebuilder:validation:Enum=gcs;kubernetes;http;s3
+	// +optional
+	Type BackendType `json:"type,omitempty" tf:"-"`
+	//S3 define the S3 compatible store of the s3 backend
+	// +optional
+	S3 *PostgresqlInstanceS3Backend `json:"s3,omitempty" tf:"-"`
+	//BucketName define the name of the GCS bucket, required by the gcs backend
+	// +optional
+	BucketName string `json:"bucketName,omitempty" tf:"bucket"`
 	//BucketPrefix GCS prefix inside the bucket
-	BucketPrefix string `json:"bucketPrefix" tf:"prefix"`
+	// +optional
+	BucketPrefix string `json:"bucketPrefix,omitempty" tf:"prefix"`
+}
+
+//PostgresqlInstanceS3Backend define an S3 compatible store, e.g. AWS S3 or MinIO
+type PostgresqlInstanceS3Backend struct {
+	//Endpoint define the address of an S3 compatible store, AWS S3 is used when empty
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+	//Bucket define the bucket holding the states
+	Bucket string `json:"bucket"`
+	//Key define the path of the state in the bucket, <namespace>/<name>/terraform.tfstate by default
+	// +optional
+	Key string `json:"key,omitempty"`
+	//Region define the region of the bucket, us-east-1 by default
+	// +optional
+	Region string `json:"region,omitempty"`
+	//ForcePathStyle addresses the bucket in the path of the requests instead of the host name, as most
+	//S3 compatible stores expect
+	// +optional
+	ForcePathStyle bool `json:"forcePathStyle,omitempty"`
+	//CredentialsSecretRef reference the Secret of the PostgreSql namespace holding the access keys of the store
+	CredentialsSecretRef PostgresqlInstanceS3Credentials `json:"credentialsSecretRef"`
+}
+
+//PostgresqlInstanceS3Credentials reference the access keys of an S3 compatible store
+type PostgresqlInstanceS3Credentials struct {
+	//Name of the Secret
+	Name string `json:"name"`
+	//AccessKeyIDKey define the key of the access key ID, AWS_ACCESS_KEY_ID by default
+	// +optional
+	AccessKeyIDKey string `json:"accessKeyIDKey,omitempty"`
+	//SecretAccessKeyKey define the key of the secret access key, AWS_SECRET_ACCESS_KEY by default
+	// +optional
+	SecretAccessKeyKey string `json:"secretAccessKeyKey,omitempty"`
+}
+
+//GetType return the backend type, gcs when it is not set
+func (in PostgresqlInstanceBackend) GetType() BackendType {
+	if in.Type == "" {
+		return BackendGCS
+	}
+	return in.Type
 }
 
 //PostgresqlInstanceStorageBucket define gcp bucket config
@@ -96,17 +328,24 @@ type PostgresqlInstanceStorageBucket struct {
 	//Location define the GCS bucket location
 	// +optional
 	Location string `json:"location" tf:"location"`
-	//Destroy When deleting a bucket, this boolean option will delete all contained objects
+	//Destroy allows the deletion of the bucket and of all its objects, once it is no longer used by any PostgreSql.
+	//Otherwise the bucket is left behind. When unset, it is read from the ProviderConfig, false by default
 	// +optional
-	Destroy bool `json:"destroy" tf:"force_destroy"`
+	Destroy *bool `json:"destroy,omitempty" tf:"force_destroy,omitempty"`
 	//StorageClass define the storage class of the bucket
 	// +optional
 	StorageClass string `json:"storageClass" tf:"storage_class"`
-	//LifecycleRules define the bucket Lifecycle Rules configuration
+	//LifecycleRules define the bucket Lifecycle Rules configuration, it deletes the noncurrent versions of the
+	//states once DefaultRetainedStateVersions newer versions exist by default
 	// +optional
 	LifecycleRule PostgresqlInstanceStorageBucketLifecycleRules `json:"lifecycleRule" tf:"lifecycle_rule"`
 }
 
+//GetDestroy return whether the deletion of the bucket is allowed
+func (in PostgresqlInstanceStorageBucket) GetDestroy() bool {
+	return in.Destroy != nil && *in.Destroy
+}
+
 type PostgresqlInstanceStorageBucketLifecycleRules struct {
 	//Condition define the Lifecycle Rule's condition configuration
 	// +optional
@@ -249,12 +488,105 @@ type PostgresInstanceOutput struct {
 	ConnectionIPAddress string `json:"connectionIPAddress,omitempty"`
 }
 
+//PostgresInstancePlan summarize the last terraform plan of the instance
+type PostgresInstancePlan struct {
+	//Add is the number of resources to create
+	Add int `json:"add"`
+	//Change is the number of resources to update in-place
+	Change int `json:"change"`
+	//Destroy is the number of resources to destroy
+	Destroy int `json:"destroy"`
+	//Resources holds the addresses of the affected resources
+	// +optional
+	Resources []string `json:"resources,omitempty"`
+	//Hash identifies the planned changes, it is the value expected by the approve-plan annotation
+	// +optional
+	Hash string `json:"hash,omitempty"`
+}
+
+//PostgreSqlStage describe the progress of a stage of the reconcile pipeline
+type PostgreSqlStage struct {
+	//Name of the stage
+	Name StageName `json:"name"`
+	//Status of the stage, one of InProgress, Completed, Failed
+	Status StageStatus `json:"status"`
+	//InputHash identifies the inputs of the last run of the stage, it is skipped while they do not change
+	// +optional
+	InputHash string `json:"inputHash,omitempty"`
+	//LastRunTime is the last time the stage ran
+	// +optional
+	LastRunTime metav1.Time `json:"lastRunTime,omitempty"`
+}
+
+//PostgreSqlStateMigration describe a migration of the terraform state between two backends
+type PostgreSqlStateMigration struct {
+	//From is the location of the state before the migration
+	From string `json:"from"`
+	//To is the location of the state after the migration
+	To string `json:"to"`
+	//Serial is the serial of the migrated state
+	Serial int64 `json:"serial"`
+	//Resources is the number of resource instances of the migrated state
+	Resources int `json:"resources"`
+	//Time is the time of the migration
+	Time metav1.Time `json:"time"`
+}
+
+//PostgreSqlCondition describe the state of the PostgreSql at a certain point
+type PostgreSqlCondition struct {
+	//Type of the condition
+	Type ConditionType `json:"type"`
+	//Status of the condition, one of True, False, Unknown
+	Status kubeApiV1.ConditionStatus `json:"status"`
+	//Reason is a brief CamelCase reason for the condition's last transition
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	//Message is a human readable message indicating details about the transition
+	// +optional
+	Message string `json:"message,omitempty"`
+	//LastTransitionTime is the last time the condition transitioned from one status to another
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
 // PostgreSqlStatus defines the observed state of PostgreSql
 type PostgreSqlStatus struct {
 	// +optional
 	Phase ObjectPhase `json:"phase,omitempty"`
 	// +optional
 	Output PostgresInstanceOutput `json:"output,omitempty"`
+	//Plan is the summary of the last terraform plan
+	// +optional
+	Plan *PostgresInstancePlan `json:"plan,omitempty"`
+	//ObservedGeneration is the last generation applied to the cloud resources
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	//Conditions holds the latest available observations of the PostgreSql
+	// +optional
+	Conditions []PostgreSqlCondition `json:"conditions,omitempty"`
+	//LastAppliedHash identifies the rendered terraform configuration and the referenced secret versions
+	//last applied, terraform does not run again until it changes
+	// +optional
+	LastAppliedHash string `json:"lastAppliedHash,omitempty"`
+	//LastReconcileRequest is the last value of the reconcile annotation handled
+	// +optional
+	LastReconcileRequest string `json:"lastReconcileRequest,omitempty"`
+	//Stages holds the progress of the reconcile pipeline
+	// +optional
+	Stages []PostgreSqlStage `json:"stages,omitempty"`
+	//Retries is the number of consecutive failed terraform runs, it drives the retry backoff
+	// +optional
+	Retries int32 `json:"retries,omitempty"`
+	//StateSerial is the serial of the terraform state of the instance, read from the http backend
+	// +optional
+	StateSerial int64 `json:"stateSerial,omitempty"`
+	//StateLocation is where the terraform state of the instance is stored, the state is migrated before
+	//being stored anywhere else
+	// +optional
+	StateLocation string `json:"stateLocation,omitempty"`
+	//StateMigration describe the last migration of the terraform state to a new remoteState
+	// +optional
+	StateMigration *PostgreSqlStateMigration `json:"stateMigration,omitempty"`
 }
 
 // +kubebuilder:object:root=true
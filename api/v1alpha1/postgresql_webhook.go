@@ -17,12 +17,17 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"context"
+	"fmt"
+	"strings"
+
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
@@ -30,7 +35,11 @@ import (
 // log is for logging in this package.
 var postgresqllog = logf.Log.WithName("postgresql-resource")
 
+// providerConfigReader reads the ProviderConfigs referenced by the PostgreSqls, the webhooks do not get any client
+var providerConfigReader client.Reader
+
 func (r *PostgreSql) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	providerConfigReader = mgr.GetAPIReader()
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
 		Complete()
@@ -44,35 +53,106 @@ var _ webhook.Defaulter = &PostgreSql{}
 func (r *PostgreSql) Default() {
 	postgresqllog.Info("createdResource", "namespace", r.Namespace, "name", r.Name)
 
-	if r.Spec.Project.Region == "" {
-		r.Spec.Project.Region = "europe-west1"
+	// The fields of a ProviderConfig are resolved whenever the PostgreSql is rendered, so that its changes
+	// reach every PostgreSql referencing it, only the location of the sql instance is defaulted from them
+	provider := r.Spec.Project
+	if r.Spec.ProviderConfigRef == nil {
+		r.SetDefaultProviderSpec()
+		provider = r.Spec.Project
+	} else if resolved, _, err := r.resolved(); err == nil {
+		provider = resolved.Spec.Project
+	} else {
+		postgresqllog.Error(err, "unable to resolve the ProviderConfig", "namespace", r.Namespace, "name", r.Name)
 	}
-	if r.Spec.Project.Zone == "" {
-		r.Spec.Project.Zone = "europe-west1-b"
+	if r.Spec.ApprovalMode == "" {
+		r.Spec.ApprovalMode = ApprovalAutomatic
+	}
+	if r.Spec.DriftPolicy == "" {
+		r.Spec.DriftPolicy = DriftReport
+	}
+	if r.Spec.DeletionPolicy == "" {
+		r.Spec.DeletionPolicy = DeletionDelete
 	}
-
-	SetDefaultBucketSpec(&r.Spec.BucketConfig, r.Spec.RemoteState.BucketName, r.Spec.Project.Name)
 
 	for k := range r.Spec.SqlInstance.Settings {
 		a := &r.Spec.SqlInstance.Settings[k]
 		SetIpConfigurationDefaultSpec(&a.IpConfiguration)
 		SetDatabaseInstanceSettingsSpec(a)
-		SetLocationPreferenceDefaultSpec(&a.LocationPreference)
+		SetLocationPreferenceDefaultSpec(&a.LocationPreference, provider.Zone)
 	}
 
 	for k := range r.Spec.Users {
 		x := &r.Spec.Users[k]
-		SetDatabaseUserDefaultSpec(x, r.Name, r.Spec.Project.Name)
+		SetDatabaseUserDefaultSpec(x, r.Name)
 	}
 	for k := range r.Spec.Databases {
 		x := &r.Spec.Databases[k]
-		SetDatabaseDefaultSpec(x, r.Name, r.Spec.Project.Name)
+		SetDatabaseDefaultSpec(x, r.Name)
 	}
 
-	SetDefaultSqlInstanceSpec(&r.Spec.SqlInstance, r.Name, r.Spec.Project.Name)
+	SetDefaultSqlInstanceSpec(&r.Spec.SqlInstance, r.Name, provider.Region)
+}
+
+//SetProjectDefaults complete the sql instance, its users and its databases with the project, the region and the
+//zone of the PostgreSql unless they set their own. It is applied whenever the PostgreSql is rendered, the project
+//is never saved on them so that they follow the PostgreSql and its ProviderConfig
+func (r *PostgreSql) SetProjectDefaults() {
+	project := r.Spec.Project
+	for k := range r.Spec.SqlInstance.Settings {
+		SetLocationPreferenceDefaultSpec(&r.Spec.SqlInstance.Settings[k].LocationPreference, project.Zone)
+	}
+	for k := range r.Spec.Users {
+		r.Spec.Users[k].Project = firstOf(r.Spec.Users[k].Project, project.Name)
+	}
+	for k := range r.Spec.Databases {
+		r.Spec.Databases[k].Project = firstOf(r.Spec.Databases[k].Project, project.Name)
+	}
+	SetDefaultSqlInstanceSpec(&r.Spec.SqlInstance, r.Name, project.Region)
+	r.Spec.SqlInstance.Project = firstOf(r.Spec.SqlInstance.Project, project.Name)
 }
 
-func SetDefaultBucketSpec(obj *PostgresqlInstanceStorageBucket, name string, project string) {
+//SetDefaultProviderSpec set the default project, remoteState and bucketConfig
+func (r *PostgreSql) SetDefaultProviderSpec() {
+	if r.Spec.Project.Region == "" {
+		r.Spec.Project.Region = "europe-west1"
+	}
+	if r.Spec.Project.Zone == "" {
+		r.Spec.Project.Zone = "europe-west1-b"
+	}
+	if r.Spec.Project.AuthMode == "" {
+		r.Spec.Project.AuthMode = AuthServiceAccountKey
+	}
+	if r.Spec.RemoteState.Type == "" {
+		r.Spec.RemoteState.Type = BackendGCS
+	}
+	if r.Spec.RemoteState.Type == BackendGCS {
+		SetDefaultBucketSpec(&r.Spec.BucketConfig, r.Spec.RemoteState.BucketName, r.Spec.Project.Name, r.Spec.Project.Region)
+	}
+	if r.Spec.RemoteState.Type == BackendS3 && r.Spec.RemoteState.S3 != nil {
+		SetDefaultS3BackendSpec(r.Spec.RemoteState.S3, r.Namespace, r.Name)
+	}
+}
+
+//resolved return a copy of the PostgreSql completed with the ProviderConfig it references, and that ProviderConfig
+//which is nil without any reference
+func (r *PostgreSql) resolved() (*PostgreSql, *ProviderConfig, error) {
+	if r.Spec.ProviderConfigRef == nil {
+		return r, nil, nil
+	}
+	if providerConfigReader == nil {
+		return nil, nil, fmt.Errorf("the ProviderConfigs cannot be read by the webhook")
+	}
+	config := &ProviderConfig{}
+	err := providerConfigReader.Get(context.Background(), client.ObjectKey{Name: r.Spec.ProviderConfigRef.Name}, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	resolved := r.DeepCopy()
+	resolved.ResolveProviderConfig(config)
+	return resolved, config, nil
+}
+
+func SetDefaultBucketSpec(obj *PostgresqlInstanceStorageBucket, name string, project string, location string) {
 	if obj.Name == "" {
 		obj.Name = name
 	}
@@ -80,47 +160,60 @@ func SetDefaultBucketSpec(obj *PostgresqlInstanceStorageBucket, name string, pro
 		obj.Project = project
 	}
 	if obj.Location == "" {
-		obj.Location = "europe-west1"
+		obj.Location = location
 	}
 	if obj.StorageClass == "" {
 		obj.StorageClass = "STANDARD"
 	}
-	obj.Destroy = true
+	if obj.Destroy == nil {
+		destroy := false
+		obj.Destroy = &destroy
+	}
 
-	p := PostgresqlInstanceStorageBucketLifecycleRules{}
-	SetDefaultBucketLifecycleRules(&p)
-	obj.LifecycleRule = p
+	SetDefaultBucketLifecycleRules(&obj.LifecycleRule)
 }
 
+//SetDefaultBucketLifecycleRules retain the last versions of the terraform states. The rule deleting
+//the objects older than 3 days, which was always set before, is replaced as it deletes the live states
 func SetDefaultBucketLifecycleRules(obj *PostgresqlInstanceStorageBucketLifecycleRules) {
+	legacy := len(obj.Condition) == 1 && obj.Condition["age"] == 3 && obj.Action["type"] == "Delete"
+	if obj.Condition == nil || legacy {
+		obj.Condition = map[string]int{
+			"num_newer_versions": DefaultRetainedStateVersions,
+		}
+	}
 	if obj.Action == nil {
 		obj.Action = map[string]string{
 			"type": "Delete",
 		}
 	}
-	if obj.Condition == nil {
-		obj.Condition = map[string]int{
-			"age": 3,
-		}
+}
+
+func SetDefaultS3BackendSpec(obj *PostgresqlInstanceS3Backend, namespace string, name string) {
+	if obj.Key == "" {
+		obj.Key = namespace + "/" + name + "/terraform.tfstate"
+	}
+	if obj.Region == "" {
+		obj.Region = "us-east-1"
+	}
+	if obj.CredentialsSecretRef.AccessKeyIDKey == "" {
+		obj.CredentialsSecretRef.AccessKeyIDKey = "AWS_ACCESS_KEY_ID"
+	}
+	if obj.CredentialsSecretRef.SecretAccessKeyKey == "" {
+		obj.CredentialsSecretRef.SecretAccessKeyKey = "AWS_SECRET_ACCESS_KEY"
 	}
 }
 
-func SetDatabaseUserDefaultSpec(obj *PostgresInstanceDatabaseUsers, name string, project string) {
+func SetDatabaseUserDefaultSpec(obj *PostgresInstanceDatabaseUsers, name string) {
 	if obj.Instance == "" {
 		obj.Instance = name
 	}
-	if obj.Project == "" {
-		obj.Project = project
-	}
 }
 
-func SetDatabaseDefaultSpec(obj *PostgresInstanceDatabases, name string, project string) {
+func SetDatabaseDefaultSpec(obj *PostgresInstanceDatabases, name string) {
 	if obj.Instance == "" {
 		obj.Instance = name
 	}
-	if obj.Project == "" {
-		obj.Project = project
-	}
 	if obj.Charset == "" {
 		obj.Charset = "UTF8"
 	}
@@ -129,9 +222,9 @@ func SetDatabaseDefaultSpec(obj *PostgresInstanceDatabases, name string, project
 	}
 }
 
-func SetLocationPreferenceDefaultSpec(obj *PostgresInstanceSettingsLocationPreference) {
+func SetLocationPreferenceDefaultSpec(obj *PostgresInstanceSettingsLocationPreference, zone string) {
 	if obj.Zone == "" {
-		obj.Zone = "europe-west1-b"
+		obj.Zone = zone
 	}
 }
 
@@ -155,20 +248,16 @@ func SetDatabaseInstanceSettingsSpec(obj *PostgresInstanceSettingsSpec) {
 	obj.DiskAutoresize = true
 }
 
-func SetDefaultSqlInstanceSpec(obj *PostgresqlInstanceSpec, name string, project string) {
+func SetDefaultSqlInstanceSpec(obj *PostgresqlInstanceSpec, name string, region string) {
 	if obj.Region == "" {
-		obj.Region = "europe-west1"
-	}
-	if obj.Project == "" {
-		obj.Project = project
+		obj.Region = region
 	}
 	if obj.Name == "" {
 		obj.Name = name
 	}
-	obj.DeletionProtection = false
 }
 
-// +kubebuilder:webhook:verbs=create;update,path=/validate-sql-terrak8s-io-v1alpha1-postgresql,mutating=false,failurePolicy=fail,groups=sql.terrak8s.io,resources=postgresqls,versions=v1alpha1,name=webhook-validator.terrak8s.io
+// +kubebuilder:webhook:verbs=create;update;delete,path=/validate-sql-terrak8s-io-v1alpha1-postgresql,mutating=false,failurePolicy=fail,groups=sql.terrak8s.io,resources=postgresqls,versions=v1alpha1,name=webhook-validator.terrak8s.io
 
 var _ webhook.Validator = &PostgreSql{}
 
@@ -187,12 +276,18 @@ func (r *PostgreSql) ValidateUpdate(old runtime.Object) error {
 
 }
 
-// ValidateDelete implements webhook.Validator, we do nothing in ValidateDelete, since we don’t need
-//to validate anything on deletion.
+// ValidateDelete implements webhook.Validator, a PostgreSql protected by deletionProtection can only
+//be deleted once the confirm-delete annotation names its cloud sql instance.
 func (r *PostgreSql) ValidateDelete() error {
 	postgresqllog.Info("validate on delete", "name", r.Name)
 
-	return nil
+	if !r.Spec.SqlInstance.DeletionProtection || r.GetAnnotations()[ConfirmDeleteAnnotation] == r.Spec.SqlInstance.Name {
+		return nil
+	}
+	return errors.NewForbidden(
+		schema.GroupResource{Group: "sql.terrak8s.io", Resource: "postgresqls"}, r.Name,
+		fmt.Errorf("cloud sql instance %q is protected by deletionProtection, annotate the PostgreSql with %s=%s to confirm its deletion",
+			r.Spec.SqlInstance.Name, ConfirmDeleteAnnotation, r.Spec.SqlInstance.Name))
 }
 
 func (r *PostgreSql) validatePostgresInstance() error {
@@ -203,6 +298,24 @@ func (r *PostgreSql) validatePostgresInstance() error {
 	if err := r.validatePostgresInstanceSettings(); err != nil {
 		allErrs = append(allErrs, err)
 	}
+	// The provider fields are validated once completed by the ProviderConfig
+	resolved, config, err := r.resolved()
+	if err != nil {
+		allErrs = append(allErrs, field.NotFound(field.NewPath("spec").Child("providerConfigRef").Child("name"), r.Spec.ProviderConfigRef.Name))
+	} else {
+		if resolved.Spec.Project.Name == "" {
+			allErrs = append(allErrs, field.Required(field.NewPath("spec").Child("project").Child("name"), "the project must be set by the PostgreSql or its ProviderConfig"))
+		}
+		if err := resolved.validateRemoteState(); err != nil {
+			allErrs = append(allErrs, err)
+		}
+		if err := resolved.validateCredentials(); err != nil {
+			allErrs = append(allErrs, err)
+		}
+		if err := resolved.validateIdentity(config); err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
 
 	if len(allErrs) == 0 {
 		return nil
@@ -231,6 +344,67 @@ func (r *PostgreSql) validatePostgresInstanceSettings() *field.Error {
 
 }
 
+func (r *PostgreSql) validateRemoteState() *field.Error {
+	path := field.NewPath("spec").Child("remoteState")
+	switch r.Spec.RemoteState.GetType() {
+	case BackendGCS:
+		if r.Spec.RemoteState.BucketName == "" {
+			return field.Required(path.Child("bucketName"), "the gcs backend requires a bucket")
+		}
+	case BackendS3:
+		s3 := r.Spec.RemoteState.S3
+		if s3 == nil || s3.Bucket == "" {
+			return field.Required(path.Child("s3").Child("bucket"), "the s3 backend requires a bucket")
+		}
+		if s3.CredentialsSecretRef.Name == "" {
+			return field.Required(path.Child("s3").Child("credentialsSecretRef").Child("name"), "the s3 backend requires access keys")
+		}
+	}
+	return nil
+}
+
+func (r *PostgreSql) validateCredentials() *field.Error {
+	project := field.NewPath("spec").Child("project")
+	if sa := r.Spec.Project.ImpersonateServiceAccount; sa != "" && (!strings.Contains(sa, "@") || !strings.HasSuffix(sa, ".gserviceaccount.com")) {
+		return field.Invalid(project.Child("impersonateServiceAccount"), sa, "must be the email of a GCP service account")
+	}
+	credentials := r.Spec.Project.Credentials
+	if credentials == nil {
+		return nil
+	}
+	if r.Spec.Project.GetAuthMode() == AuthWorkloadIdentity {
+		return field.Forbidden(project.Child("credentials"), "the WorkloadIdentity authMode does not use any serviceAccount json key")
+	}
+	path := project.Child("credentials").Child("secretKeyRef")
+	if credentials.SecretKeyRef.Name == "" {
+		return field.Required(path.Child("name"), "the credentials secret must be named")
+	}
+	if credentials.SecretKeyRef.Key == "" {
+		return field.Required(path.Child("key"), "the key of the service account json key must be set")
+	}
+	if errs := validation.IsConfigMapKey(credentials.SecretKeyRef.Key); len(errs) > 0 {
+		return field.Invalid(path.Child("key"), credentials.SecretKeyRef.Key, errs[0])
+	}
+	return nil
+}
+
+//validateIdentity check that the identity of the operator is only used as allowed by the identityPolicies of the
+//ProviderConfig, for the namespace of the PostgreSql
+func (r *PostgreSql) validateIdentity(config *ProviderConfig) *field.Error {
+	project := field.NewPath("spec").Child("project")
+	policies := &ProviderConfigSpec{}
+	if config != nil {
+		policies = &config.Spec
+	}
+	if r.Spec.Project.GetAuthMode() == AuthWorkloadIdentity && !policies.AllowsWorkloadIdentity(r.Namespace) {
+		return field.Forbidden(project.Child("authMode"), fmt.Sprintf("the WorkloadIdentity authMode is not allowed in namespace %q by the identityPolicies of the ProviderConfig", r.Namespace))
+	}
+	if sa := r.Spec.Project.ImpersonateServiceAccount; sa != "" && !policies.AllowsImpersonation(r.Namespace, sa) {
+		return field.Forbidden(project.Child("impersonateServiceAccount"), fmt.Sprintf("%s may not be impersonated in namespace %q according to the identityPolicies of the ProviderConfig", sa, r.Namespace))
+	}
+	return nil
+}
+
 //ContainsVersion is helper func
 func ContainsVersion(slice []string, s string) bool {
 	for _, item := range slice {
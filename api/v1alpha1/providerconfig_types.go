@@ -0,0 +1,161 @@
+/*
+Copyright 2020 The Terrak8s-operator authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"path"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ProviderConfigSpec defines the project, credentials and state backend shared by the PostgreSqls
+// referencing the ProviderConfig
+type ProviderConfigSpec struct {
+	//Project define the GCP project, its region and zone, the credentials of terraform and the version of the
+	//google provider
+	// +optional
+	Project PostgresqlInstanceProvider `json:"project,omitempty"`
+	//RemoteState define the terraform backend. The bucketPrefix of the gcs backend and the key of the s3 backend
+	//are followed by <namespace>/<name> of every PostgreSql
+	// +optional
+	RemoteState PostgresqlInstanceBackend `json:"remoteState,omitempty"`
+	//BucketConfig define the state bucket of the gcs backend
+	// +optional
+	BucketConfig PostgresqlInstanceStorageBucket `json:"bucketConfig,omitempty"`
+	//IdentityPolicies allow the PostgreSqls of some namespaces to use the identity of the operator. Without any
+	//policy, no PostgreSql may use the WorkloadIdentity authMode or impersonate a service account
+	// +optional
+	IdentityPolicies []IdentityPolicy `json:"identityPolicies,omitempty"`
+}
+
+//IdentityPolicy allow the PostgreSqls of its namespaces to run terraform with the ambient credentials of the
+//operator, or to impersonate some service accounts
+type IdentityPolicy struct {
+	//Namespaces the policy applies to
+	Namespaces []string `json:"namespaces"`
+	//WorkloadIdentity allows the WorkloadIdentity authMode
+	// +optional
+	WorkloadIdentity bool `json:"workloadIdentity,omitempty"`
+	//ImpersonableServiceAccounts lists the emails of the GCP service accounts which may be impersonated
+	// +optional
+	ImpersonableServiceAccounts []string `json:"impersonableServiceAccounts,omitempty"`
+}
+
+//AllowsWorkloadIdentity return whether the PostgreSqls of namespace may use the WorkloadIdentity authMode
+func (in *ProviderConfigSpec) AllowsWorkloadIdentity(namespace string) bool {
+	for _, policy := range in.IdentityPolicies {
+		if policy.WorkloadIdentity && ContainsVersion(policy.Namespaces, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+//AllowsImpersonation return whether the PostgreSqls of namespace may impersonate serviceAccount
+func (in *ProviderConfigSpec) AllowsImpersonation(namespace string, serviceAccount string) bool {
+	for _, policy := range in.IdentityPolicies {
+		if ContainsVersion(policy.Namespaces, namespace) && ContainsVersion(policy.ImpersonableServiceAccounts, serviceAccount) {
+			return true
+		}
+	}
+	return false
+}
+
+//ProviderConfigReference reference a ProviderConfig by name
+type ProviderConfigReference struct {
+	//Name of the ProviderConfig
+	Name string `json:"name"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=pc
+// +kubebuilder:printcolumn:name="Project",type=string,JSONPath=`.spec.project.name`
+// +kubebuilder:printcolumn:name="Backend",type=string,JSONPath=`.spec.remoteState.type`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ProviderConfig is the Schema for the providerconfigs API
+type ProviderConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ProviderConfigSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ProviderConfigList contains a list of ProviderConfig
+type ProviderConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ProviderConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ProviderConfig{}, &ProviderConfigList{})
+}
+
+// ResolveProviderConfig complete the spec with the ProviderConfig it references: the project, remoteState and
+// bucketConfig fields which are not set take the values of the ProviderConfig, then the default values
+func (r *PostgreSql) ResolveProviderConfig(config *ProviderConfig) {
+	shared := config.Spec.DeepCopy()
+	project := &r.Spec.Project
+	project.Name = firstOf(project.Name, shared.Project.Name)
+	project.Region = firstOf(project.Region, shared.Project.Region)
+	project.Zone = firstOf(project.Zone, shared.Project.Zone)
+	project.AuthMode = AuthMode(firstOf(string(project.AuthMode), string(shared.Project.AuthMode)))
+	project.ImpersonateServiceAccount = firstOf(project.ImpersonateServiceAccount, shared.Project.ImpersonateServiceAccount)
+	project.ProviderVersion = firstOf(project.ProviderVersion, shared.Project.ProviderVersion)
+	if project.Credentials == nil {
+		project.Credentials = shared.Project.Credentials
+	}
+
+	// The states of the PostgreSqls sharing a backend are kept apart
+	state := &r.Spec.RemoteState
+	state.Type = BackendType(firstOf(string(state.Type), string(shared.RemoteState.Type)))
+	state.BucketName = firstOf(state.BucketName, shared.RemoteState.BucketName)
+	if state.BucketPrefix == "" && shared.RemoteState.BucketName != "" {
+		state.BucketPrefix = path.Join(shared.RemoteState.BucketPrefix, r.Namespace, r.Name)
+	}
+	if state.S3 == nil && shared.RemoteState.S3 != nil {
+		state.S3 = shared.RemoteState.S3
+		state.S3.Key = path.Join(state.S3.Key, r.Namespace, r.Name, "terraform.tfstate")
+	}
+
+	bucket := &r.Spec.BucketConfig
+	bucket.Name = firstOf(bucket.Name, shared.BucketConfig.Name)
+	bucket.Project = firstOf(bucket.Project, shared.BucketConfig.Project)
+	bucket.Location = firstOf(bucket.Location, shared.BucketConfig.Location)
+	bucket.StorageClass = firstOf(bucket.StorageClass, shared.BucketConfig.StorageClass)
+	if bucket.Destroy == nil {
+		bucket.Destroy = shared.BucketConfig.Destroy
+	}
+	if bucket.LifecycleRule.Condition == nil && bucket.LifecycleRule.Action == nil {
+		bucket.LifecycleRule = shared.BucketConfig.LifecycleRule
+	}
+
+	r.SetDefaultProviderSpec()
+	r.SetProjectDefaults()
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
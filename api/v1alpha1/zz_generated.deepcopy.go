@@ -21,16 +21,42 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IdentityPolicy) DeepCopyInto(out *IdentityPolicy) {
+	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ImpersonableServiceAccounts != nil {
+		in, out := &in.ImpersonableServiceAccounts, &out.ImpersonableServiceAccounts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IdentityPolicy.
+func (in *IdentityPolicy) DeepCopy() *IdentityPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(IdentityPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostgreSql) DeepCopyInto(out *PostgreSql) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgreSql.
@@ -51,6 +77,22 @@ func (in *PostgreSql) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgreSqlCondition) DeepCopyInto(out *PostgreSqlCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgreSqlCondition.
+func (in *PostgreSqlCondition) DeepCopy() *PostgreSqlCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgreSqlCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostgreSqlList) DeepCopyInto(out *PostgreSqlList) {
 	*out = *in
@@ -86,8 +128,13 @@ func (in *PostgreSqlList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostgreSqlSpec) DeepCopyInto(out *PostgreSqlSpec) {
 	*out = *in
-	out.Project = in.Project
-	out.RemoteState = in.RemoteState
+	if in.ProviderConfigRef != nil {
+		in, out := &in.ProviderConfigRef, &out.ProviderConfigRef
+		*out = new(ProviderConfigReference)
+		**out = **in
+	}
+	in.Project.DeepCopyInto(&out.Project)
+	in.RemoteState.DeepCopyInto(&out.RemoteState)
 	in.BucketConfig.DeepCopyInto(&out.BucketConfig)
 	in.SqlInstance.DeepCopyInto(&out.SqlInstance)
 	if in.Databases != nil {
@@ -100,6 +147,11 @@ func (in *PostgreSqlSpec) DeepCopyInto(out *PostgreSqlSpec) {
 		*out = make([]PostgresInstanceDatabaseUsers, len(*in))
 		copy(*out, *in)
 	}
+	if in.DriftCheckInterval != nil {
+		in, out := &in.DriftCheckInterval, &out.DriftCheckInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgreSqlSpec.
@@ -112,10 +164,66 @@ func (in *PostgreSqlSpec) DeepCopy() *PostgreSqlSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgreSqlStage) DeepCopyInto(out *PostgreSqlStage) {
+	*out = *in
+	in.LastRunTime.DeepCopyInto(&out.LastRunTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgreSqlStage.
+func (in *PostgreSqlStage) DeepCopy() *PostgreSqlStage {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgreSqlStage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgreSqlStateMigration) DeepCopyInto(out *PostgreSqlStateMigration) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgreSqlStateMigration.
+func (in *PostgreSqlStateMigration) DeepCopy() *PostgreSqlStateMigration {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgreSqlStateMigration)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostgreSqlStatus) DeepCopyInto(out *PostgreSqlStatus) {
 	*out = *in
 	out.Output = in.Output
+	if in.Plan != nil {
+		in, out := &in.Plan, &out.Plan
+		*out = new(PostgresInstancePlan)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]PostgreSqlCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Stages != nil {
+		in, out := &in.Stages, &out.Stages
+		*out = make([]PostgreSqlStage, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.StateMigration != nil {
+		in, out := &in.StateMigration, &out.StateMigration
+		*out = new(PostgreSqlStateMigration)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgreSqlStatus.
@@ -205,6 +313,26 @@ func (in *PostgresInstanceOutput) DeepCopy() *PostgresInstanceOutput {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresInstancePlan) DeepCopyInto(out *PostgresInstancePlan) {
+	*out = *in
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresInstancePlan.
+func (in *PostgresInstancePlan) DeepCopy() *PostgresInstancePlan {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresInstancePlan)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostgresInstanceSettingsBackupConfiguration) DeepCopyInto(out *PostgresInstanceSettingsBackupConfiguration) {
 	*out = *in
@@ -314,6 +442,11 @@ func (in *PostgresInstanceSettingsSpec) DeepCopy() *PostgresInstanceSettingsSpec
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostgresqlInstanceBackend) DeepCopyInto(out *PostgresqlInstanceBackend) {
 	*out = *in
+	if in.S3 != nil {
+		in, out := &in.S3, &out.S3
+		*out = new(PostgresqlInstanceS3Backend)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresqlInstanceBackend.
@@ -326,9 +459,30 @@ func (in *PostgresqlInstanceBackend) DeepCopy() *PostgresqlInstanceBackend {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresqlInstanceCredentials) DeepCopyInto(out *PostgresqlInstanceCredentials) {
+	*out = *in
+	out.SecretKeyRef = in.SecretKeyRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresqlInstanceCredentials.
+func (in *PostgresqlInstanceCredentials) DeepCopy() *PostgresqlInstanceCredentials {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresqlInstanceCredentials)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostgresqlInstanceProvider) DeepCopyInto(out *PostgresqlInstanceProvider) {
 	*out = *in
+	if in.Credentials != nil {
+		in, out := &in.Credentials, &out.Credentials
+		*out = new(PostgresqlInstanceCredentials)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresqlInstanceProvider.
@@ -341,6 +495,37 @@ func (in *PostgresqlInstanceProvider) DeepCopy() *PostgresqlInstanceProvider {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresqlInstanceS3Backend) DeepCopyInto(out *PostgresqlInstanceS3Backend) {
+	*out = *in
+	out.CredentialsSecretRef = in.CredentialsSecretRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresqlInstanceS3Backend.
+func (in *PostgresqlInstanceS3Backend) DeepCopy() *PostgresqlInstanceS3Backend {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresqlInstanceS3Backend)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresqlInstanceS3Credentials) DeepCopyInto(out *PostgresqlInstanceS3Credentials) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresqlInstanceS3Credentials.
+func (in *PostgresqlInstanceS3Credentials) DeepCopy() *PostgresqlInstanceS3Credentials {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresqlInstanceS3Credentials)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostgresqlInstanceSpec) DeepCopyInto(out *PostgresqlInstanceSpec) {
 	*out = *in
@@ -366,6 +551,11 @@ func (in *PostgresqlInstanceSpec) DeepCopy() *PostgresqlInstanceSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PostgresqlInstanceStorageBucket) DeepCopyInto(out *PostgresqlInstanceStorageBucket) {
 	*out = *in
+	if in.Destroy != nil {
+		in, out := &in.Destroy, &out.Destroy
+		*out = new(bool)
+		**out = **in
+	}
 	in.LifecycleRule.DeepCopyInto(&out.LifecycleRule)
 }
 
@@ -407,3 +597,101 @@ func (in *PostgresqlInstanceStorageBucketLifecycleRules) DeepCopy() *PostgresqlI
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProviderConfig) DeepCopyInto(out *ProviderConfig) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProviderConfig.
+func (in *ProviderConfig) DeepCopy() *ProviderConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ProviderConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ProviderConfig) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProviderConfigList) DeepCopyInto(out *ProviderConfigList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ProviderConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProviderConfigList.
+func (in *ProviderConfigList) DeepCopy() *ProviderConfigList {
+	if in == nil {
+		return nil
+	}
+	out := new(ProviderConfigList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ProviderConfigList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProviderConfigReference) DeepCopyInto(out *ProviderConfigReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProviderConfigReference.
+func (in *ProviderConfigReference) DeepCopy() *ProviderConfigReference {
+	if in == nil {
+		return nil
+	}
+	out := new(ProviderConfigReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProviderConfigSpec) DeepCopyInto(out *ProviderConfigSpec) {
+	*out = *in
+	in.Project.DeepCopyInto(&out.Project)
+	in.RemoteState.DeepCopyInto(&out.RemoteState)
+	in.BucketConfig.DeepCopyInto(&out.BucketConfig)
+	if in.IdentityPolicies != nil {
+		in, out := &in.IdentityPolicies, &out.IdentityPolicies
+		*out = make([]IdentityPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProviderConfigSpec.
+func (in *ProviderConfigSpec) DeepCopy() *ProviderConfigSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProviderConfigSpec)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -18,22 +18,33 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/HamzaZo/terrak8s-operator/pkg/statebackend"
 	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
 	"github.com/HamzaZo/terrak8s-operator/pkg/util"
+	"github.com/HamzaZo/terrak8s-operator/pkg/workspace"
 	"github.com/go-logr/logr"
 	"io/ioutil"
 	kubeApiV1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	"os"
 	"path/filepath"
+	"sort"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"strings"
 	"time"
 )
@@ -47,12 +58,15 @@ const (
 	MessageResourceSynced = "PostgreSql Resource synced successfully"
 	//Finalizer name of  finalizer
 	Finalizer = "sql.terrak8s.io"
+	//credentialsEnv holds the serviceAccount json key in the environment of the terraform runs, read by the google
+	//provider and the gcs backend
+	credentialsEnv = "GOOGLE_CREDENTIALS"
+	//StateExportAnnotation holds the namespace/name of the PostgreSql whose states are exported to a Secret
+	StateExportAnnotation = "sql.terrak8s.io/exported-from"
 )
 
 var (
 	secretList kubeApiV1.SecretList
-	dir        string
-
 )
 
 // PostgreSqlReconciler reconciles a PostgreSql object
@@ -61,11 +75,31 @@ type PostgreSqlReconciler struct {
 	Log      logr.Logger
 	Scheme   *runtime.Scheme
 	Recorder record.EventRecorder
+	// Executor runs the terraform commands of every reconcile
+	Executor terraform.Executor
+	// DriftCheckInterval is the default period between two drift checks, zero disables them
+	DriftCheckInterval time.Duration
+	// Workspaces hands out the terraform workspace of every PostgreSql
+	Workspaces *workspace.Manager
+	// StateExportNamespace holds the states exported by the Orphan deletion policy, the
+	// namespace of the PostgreSql is used when empty
+	StateExportNamespace string
+	// StateBackendAddress is the base address of the http backend served by the manager, the
+	// http backend cannot be used when empty
+	StateBackendAddress string
+	// APIReader reads the states of the http backend bypassing the cache, the client is used when nil
+	APIReader client.Reader
 }
 
 // +kubebuilder:rbac:groups=sql.terrak8s.io,resources=postgresqls,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=sql.terrak8s.io,resources=postgresqls/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=sql.terrak8s.io,resources=providerconfigs,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;delete
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;create;update;delete
+// +kubebuilder:rbac:groups="",resources=pods,verbs=list
+// +kubebuilder:rbac:groups="",resources=pods/log,verbs=get
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
 
 func (r *PostgreSqlReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -82,39 +116,133 @@ func (r *PostgreSqlReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		log.Error(err, "unable to fetch PostgreSql")
 		return ctrl.Result{}, err
 	}
+	// The spec is completed by its ProviderConfig at every reconcile, it is never saved
+	err = r.ResolveProviderConfig(ctx, instance)
+	if err != nil {
+		log.Error(err, "unable to resolve the ProviderConfig")
+		if !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		if confirmed, ok := instance.GetAnnotations()[sqlv1alpha1.AbandonAnnotation]; ok && util.IsBeingDeleted(instance) && confirmed == instance.Spec.SqlInstance.Name {
+			// The cloud resources cannot be destroyed without the ProviderConfig, they are left behind
+			return r.AbandoningInstance(ctx, req.NamespacedName, instance)
+		}
+		SetProviderConfigNotFound(instance, err)
+		// A PostgreSql being deleted is only destroyed with its ProviderConfig, or abandoned once its deletion is confirmed
+		phase := sqlv1alpha1.PhaseFailed
+		if util.IsBeingDeleted(instance) {
+			phase = instance.Status.Phase
+			r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "ProviderConfigNotFound", "failed to resolve ProviderConfig %q: %v, annotate the instance with %s=%s to delete it without destroying its cloud resources", instance.Spec.ProviderConfigRef.Name, err, sqlv1alpha1.AbandonAnnotation, instance.Spec.SqlInstance.Name)
+		} else {
+			r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "ProviderConfigNotFound", "failed to resolve ProviderConfig %q: %v", instance.Spec.ProviderConfigRef.Name, err)
+		}
+		errUp := r.UpdateStatus(ctx, instance, phase)
+		if errUp != nil {
+			return ctrl.Result{}, errUp
+		}
+		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+	}
+	if SetProviderConfigNotFound(instance, nil) {
+		errUp := r.UpdateStatus(ctx, instance, instance.Status.Phase)
+		if errUp != nil {
+			return ctrl.Result{}, errUp
+		}
+	}
+	// Every reconcile works in the workspace of its own PostgreSql
+	dir, err := r.Workspaces.Create(req.NamespacedName)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to create instance %v/%v tf dir", instance.Namespace, instance.Name)
+		r.Log.Error(err, errMsg)
+		return ctrl.Result{}, err
+	}
 	if util.IsBeingDeleted(instance) {
 		if instance.Status.Phase == sqlv1alpha1.PhaseFailed || instance.Status.Phase == sqlv1alpha1.PhaseInitializing{
 			util.RemoveFinalizer(instance, Finalizer)
-			errC := util.HouseCleaning(dir)
+			errC := r.Workspaces.Remove(req.NamespacedName)
 			if errC != nil {
 				errMsg := fmt.Sprintf("failed to do houseCleaning for instance %v/%v ", instance.Namespace, instance.Name)
 				r.Log.Error(errC, errMsg)
 				return ctrl.Result{Requeue: true}, nil
 			}
-			if errU := r.Update(context.Background(), instance); errU != nil {
+			if errU := r.UpdateFinalizers(ctx, instance); errU != nil {
 				return ctrl.Result{}, errU
 			}
 			return ctrl.Result{}, nil
 
 		} else {
-			errD := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseDestroying)
-			if errD != nil {
-				return ctrl.Result{}, errD
-			}
-			errs := terraform.Destroy(dir)
-			if errs != nil {
-				errMsg := fmt.Sprintf("failed to destroy instance %v/%v ", instance.Namespace, instance.Name)
-				log.Error(errs, errMsg)
-				return ctrl.Result{Requeue: true}, nil
+			switch instance.Spec.DeletionPolicy {
+			case sqlv1alpha1.DeletionRetain:
+				if instance.Spec.RemoteState.GetType() == sqlv1alpha1.BackendHTTP {
+					// The state Secret would be collected with the PostgreSql
+					errR := statebackend.Release(ctx, r.Client, instance)
+					if errR != nil {
+						return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+					}
+				}
+				if UsesStateBucket(instance) {
+					// The state of the bucket is local to the workspace, removed with it
+					env, errS := r.GetTerraformEnv(secretList, req.Namespace, ctx, instance, dir)
+					if errS != nil {
+						return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+					}
+					errE := r.ExportingState(ctx, dir, env, instance, "bucket")
+					if errE != nil {
+						return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+					}
+				}
+				r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "Retained", "cloud sql instance %q and its state in the %s backend are retained", instance.Spec.SqlInstance.Name, instance.Spec.RemoteState.GetType())
+			case sqlv1alpha1.DeletionOrphan:
+				env, errS := r.GetTerraformEnv(secretList, req.Namespace, ctx, instance, dir)
+				if errS != nil {
+					return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+				}
+				errE := r.ExportingState(ctx, dir, env, instance, StateModules(instance)...)
+				if errE != nil {
+					return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+				}
+				r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "Orphaned", "cloud sql instance %q is orphaned", instance.Spec.SqlInstance.Name)
+			default:
+				errD := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseDestroying)
+				if errD != nil {
+					return ctrl.Result{}, errD
+				}
+				env, errS := r.GetTerraformEnv(secretList, req.Namespace, ctx, instance, dir)
+				if errS != nil {
+					return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+				}
+				if instance.Spec.SqlInstance.DeletionProtection {
+					// The deletion has been confirmed, see ValidateDelete
+					errU := r.UnprotectingInstance(ctx, dir, env, instance)
+					if errU != nil {
+						return ctrl.Result{RequeueAfter: RetryAfter(instance)}, nil
+					}
+				}
+				modules, errB := r.GetDestroyedModules(ctx, instance)
+				if errB != nil {
+					return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+				}
+				errs := terraform.Destroy(ctx, r.Executor, dir, env, modules...)
+				if errs != nil {
+					if r.IsStateLocked(ctx, dir, env, instance, errs) {
+						return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+					}
+					errMsg := fmt.Sprintf("failed to destroy instance %v/%v ", instance.Namespace, instance.Name)
+					log.Error(errs, errMsg)
+					return ctrl.Result{Requeue: true}, nil
+				}
+				errK := r.DeletingStateSecrets(ctx, instance)
+				if errK != nil {
+					return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+				}
 			}
-			errC := util.HouseCleaning(dir)
+			errC := r.Workspaces.Remove(req.NamespacedName)
 			if errC != nil {
 				errMsg := fmt.Sprintf("failed to do houseCleaning for instance %v/%v ", instance.Namespace, instance.Name)
 				r.Log.Error(errC, errMsg)
 				return ctrl.Result{Requeue: true}, nil
 			}
 			util.RemoveFinalizer(instance, Finalizer)
-			if errU := r.Update(context.Background(), instance); errU != nil {
+			if errU := r.UpdateFinalizers(ctx, instance); errU != nil {
 				return ctrl.Result{}, errU
 			}
 			// Stop reconciliation as the item is being deleted
@@ -122,16 +250,9 @@ func (r *PostgreSqlReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		}
 	} else {
 		util.AddFinalizer(instance, Finalizer)
-		if err := r.Update(context.Background(), instance); err != nil {
+		if err := r.UpdateFinalizers(ctx, instance); err != nil {
 			return ctrl.Result{}, err
 		}
-		dir, err = util.CreateDirectory(instance.Namespace, instance.Name)
-		if err != nil {
-			errMsg := fmt.Sprintf("failed to create instance %v/%v tf dir", instance.Namespace, instance.Name)
-			r.Log.Error(err, errMsg)
-			return ctrl.Result{}, err
-		}
-
 	}
 
 	b, err := r.FetchUserPasswordFromSecret(req.Namespace, instance, ctx, secretList)
@@ -143,7 +264,7 @@ func (r *PostgreSqlReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
 	}
 
-	errS := r.GetGCPCredentialsFromSecret(secretList, req.Namespace, ctx, instance, dir)
+	env, errS := r.GetTerraformEnv(secretList, req.Namespace, ctx, instance, dir)
 	if errS != nil {
 		errUp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseFailed)
 		if errUp != nil {
@@ -151,60 +272,209 @@ func (r *PostgreSqlReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		}
 		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
 	}
+	// The passwords of the users are only passed to the terraform runs
+	env = append(env, terraform.PasswordEnv(instance, b)...)
 
-	errF := r.GenerateTFFromCR(instance, dir, b)
+	endpoint, errE := r.GetStateEndpoint(ctx, instance)
+	if errE != nil {
+		errUp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseFailed)
+		if errUp != nil {
+			return ctrl.Result{}, errUp
+		}
+		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+	}
+
+	errF := r.GenerateTFFromCR(instance, dir, b, endpoint)
 	if errF != nil {
 		return ctrl.Result{}, errF
 	}
 
-	errUp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseInitializing)
-	if errUp != nil {
-		return ctrl.Result{}, err
+	versions, errV := r.GetSecretVersions(ctx, req.Namespace, instance)
+	if errV != nil {
+		return ctrl.Result{}, errV
 	}
-	errSo := r.ProvisioningStorageBucket(dir, instance, ctx)
-	if errSo != nil {
-		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+	inputs, errH := StageInputs(dir, instance, versions)
+	if errH != nil {
+		return ctrl.Result{}, errH
+	}
+	appliedHash := AppliedHash(inputs, versions)
+	// A drift check keeps the instance Running unless the drift is corrected
+	driftCheck := false
+	if IsReconcileRequested(instance) {
+		instance.Status.LastReconcileRequest = instance.GetAnnotations()[sqlv1alpha1.ReconcileAnnotation]
+		ResetStages(instance, sqlv1alpha1.StageBucket)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "ReconcileRequested", "running every stage of cloud sql instance %q again", instance.Name)
+	} else if IsUpToDate(instance, appliedHash) {
+		if instance.Status.ObservedGeneration != instance.Generation {
+			// The spec changed without changing the terraform configuration
+			instance.Status.ObservedGeneration = instance.Generation
+			if errUp := r.UpdateStatus(ctx, instance, instance.Status.Phase); errUp != nil {
+				return ctrl.Result{}, errUp
+			}
+		}
+		interval := r.GetDriftCheckInterval(instance)
+		if interval <= 0 {
+			return ctrl.Result{}, nil
+		}
+		if wait := NextDriftCheck(instance, interval, time.Now()); wait > 0 {
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
+		driftCheck = true
 	}
-	r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "SuccessfulApplying", "successfully provision storage bucket %q", instance.Spec.RemoteState.BucketName)
 
-	errI := r.InitializeRemoteBackend(dir, instance, ctx)
-	if errI != nil {
-		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+	// The kubernetes backend does not need any bucket
+	bucketDone := !UsesStateBucket(instance) || IsStageDone(instance, dir, sqlv1alpha1.StageBucket, inputs[sqlv1alpha1.StageBucket])
+	backendDone := IsStageDone(instance, dir, sqlv1alpha1.StageBackend, inputs[sqlv1alpha1.StageBackend])
+	if !driftCheck && (!bucketDone || !backendDone) {
+		errUp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseInitializing)
+		if errUp != nil {
+			return ctrl.Result{}, errUp
+		}
+	}
+	if !bucketDone {
+		StartStage(instance, sqlv1alpha1.StageBucket, inputs[sqlv1alpha1.StageBucket])
+		errSo := r.ProvisioningStorageBucket(dir, env, instance, ctx)
+		if errSo != nil {
+			return ctrl.Result{RequeueAfter: RetryAfter(instance)}, nil
+		}
+		CompleteStage(instance, sqlv1alpha1.StageBucket)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "SuccessfulApplying", "successfully provision storage bucket %q", instance.Spec.RemoteState.BucketName)
 	}
 
-	r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "SuccessfulInitialize", "successfully configured the remote backend \"gcs\" bucket")
+	if !backendDone {
+		location, errL := terraform.StateLocation(instance)
+		if errL != nil {
+			return ctrl.Result{}, errL
+		}
+		migrate := IsStateMigrationRequired(instance, location)
+		if migrate && !IsStateMigrationConfirmed(instance) {
+			errAw := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseAwaitingApproval)
+			if errAw != nil {
+				return ctrl.Result{}, errAw
+			}
+			r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "StateMigrationRequired", "the terraform state is stored in %s, set the %s annotation to %q to migrate it to %s",
+				instance.Status.StateLocation, sqlv1alpha1.MigrateStateAnnotation, instance.Spec.RemoteState.GetType(), location)
+			// Wait for the migrate-state annotation to be set
+			return ctrl.Result{}, nil
+		}
+		StartStage(instance, sqlv1alpha1.StageBackend, inputs[sqlv1alpha1.StageBackend])
+		var errI error
+		if migrate {
+			errI = r.MigratingState(dir, env, instance, location, ctx)
+		} else {
+			errI = r.InitializeRemoteBackend(dir, env, instance, ctx)
+		}
+		if errI != nil {
+			return ctrl.Result{RequeueAfter: RetryAfter(instance)}, nil
+		}
+		if migrate {
+			// A later change of the remoteState needs a new confirmation
+			errC := r.ConsumeAnnotation(ctx, instance, sqlv1alpha1.MigrateStateAnnotation)
+			if errC != nil {
+				return ctrl.Result{}, errC
+			}
+		}
+		instance.Status.StateLocation = location
+		CompleteStage(instance, sqlv1alpha1.StageBackend)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "SuccessfulInitialize", "successfully configured the remote backend %q", instance.Spec.RemoteState.GetType())
+	}
 
-	errAp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseApplying)
-	if errAp != nil {
-		return ctrl.Result{}, err
+	if driftCheck {
+		StartStage(instance, sqlv1alpha1.StageDriftCheck, inputs[sqlv1alpha1.StageDriftCheck])
+		drifted, errDr := r.DetectingDrift(dir, env, instance, ctx)
+		if errDr != nil {
+			return ctrl.Result{RequeueAfter: RetryAfter(instance)}, nil
+		}
+		if !drifted || instance.Spec.DriftPolicy != sqlv1alpha1.DriftCorrect {
+			return ctrl.Result{RequeueAfter: r.GetDriftCheckInterval(instance)}, nil
+		}
+		// Apply the spec again
+		ResetStages(instance, sqlv1alpha1.StageInstance)
 	}
-	errP := r.ProvisioningInstance(dir, instance, ctx)
-	if errP != nil {
-		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+
+	if !IsStageDone(instance, dir, sqlv1alpha1.StageInstance, inputs[sqlv1alpha1.StageInstance]) {
+		errAp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseApplying)
+		if errAp != nil {
+			return ctrl.Result{}, errAp
+		}
+		StartStage(instance, sqlv1alpha1.StageInstance, inputs[sqlv1alpha1.StageInstance])
+		if instance.Spec.Adopt {
+			errAd := r.AdoptingInstance(dir, env, instance, ctx)
+			if errAd != nil {
+				return ctrl.Result{RequeueAfter: RetryAfter(instance)}, nil
+			}
+		}
+		plan, errPl := r.PlanningInstance(dir, env, instance, ctx)
+		if errPl != nil {
+			return ctrl.Result{RequeueAfter: RetryAfter(instance)}, nil
+		}
+		if plan.HasChanges() {
+			if !r.IsPlanApproved(instance, plan) {
+				// The plan is created again once approved
+				errRm := terraform.RemovePlan(filepath.Join(dir, "instance"))
+				if errRm != nil {
+					return ctrl.Result{}, errRm
+				}
+				errAw := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseAwaitingApproval)
+				if errAw != nil {
+					return ctrl.Result{}, errAw
+				}
+				// Wait for the approve-plan annotation to be set
+				return ctrl.Result{}, nil
+			}
+			errP := r.ProvisioningInstance(dir, env, instance, ctx)
+			if errP != nil {
+				return ctrl.Result{RequeueAfter: RetryAfter(instance)}, nil
+			}
+			errC := r.ConsumeAnnotation(ctx, instance, sqlv1alpha1.ApprovePlanAnnotation)
+			if errC != nil {
+				return ctrl.Result{}, errC
+			}
+			r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "SuccessfullyApplying", "successfully creating cloud sql instance %q", instance.Name)
+		}
+		CompleteStage(instance, sqlv1alpha1.StageInstance)
 	}
-	r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "SuccessfullyApplying", "successfully creating cloud sql instance %q", instance.Name)
 
-	out, errO := r.GetOutput(dir, instance)
-	if errO != nil {
-		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+	if !IsStageDone(instance, dir, sqlv1alpha1.StageOutput, inputs[sqlv1alpha1.StageOutput]) {
+		StartStage(instance, sqlv1alpha1.StageOutput, inputs[sqlv1alpha1.StageOutput])
+		_, errO := r.GetOutput(ctx, dir, env, instance)
+		if errO != nil {
+			return ctrl.Result{RequeueAfter: RetryAfter(instance)}, nil
+		}
+		CompleteStage(instance, sqlv1alpha1.StageOutput)
+	}
+	instance.Status.ObservedGeneration = instance.Generation
+	instance.Status.LastAppliedHash = appliedHash
+	ClearFailure(instance)
+	if c := util.GetCondition(instance.Status.Conditions, sqlv1alpha1.ConditionDrifted); c != nil && c.Status == kubeApiV1.ConditionTrue {
+		// The instance has just been applied, it matches its spec again
+		util.SetCondition(&instance.Status.Conditions, sqlv1alpha1.PostgreSqlCondition{
+			Type:    sqlv1alpha1.ConditionDrifted,
+			Status:  kubeApiV1.ConditionFalse,
+			Reason:  "DriftCorrected",
+			Message: "cloud sql instance has been applied again from the PostgreSql spec",
+		})
 	}
-	errR := r.UpdateStatus(ctx, out, sqlv1alpha1.PhaseRunning)
+	errR := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseRunning)
 	if errR != nil {
-		return ctrl.Result{}, err
+		return ctrl.Result{}, errR
 	}
 
 	log.Info("resource status synced")
 
 	r.Recorder.Event(instance, kubeApiV1.EventTypeNormal, SuccessSynced, MessageResourceSynced)
 
-	// Don't requeue. We should be reconcile because the CR changes.
-	return ctrl.Result{}, nil
+	// Requeue for the next drift check, if any. Otherwise we should be reconcile because the CR changes.
+	return ctrl.Result{RequeueAfter: r.GetDriftCheckInterval(instance)}, nil
 }
 
 func (r *PostgreSqlReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	pred := predicate.GenerationChangedPredicate{}
+	pred := predicate.Or(predicate.GenerationChangedPredicate{}, AnnotationChangedPredicate{})
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&sqlv1alpha1.PostgreSql{}).
+		Watches(&source.Kind{Type: &sqlv1alpha1.ProviderConfig{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.PostgreSqlsOfProviderConfig),
+		}).
 		WithEventFilter(pred).
 		WithOptions(controller.Options{
 			MaxConcurrentReconciles: 10,
@@ -212,9 +482,194 @@ func (r *PostgreSqlReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Complete(r)
 }
 
-//GetGCPCredentialsFromSecret fetch gcp serviceAccount from secret
-func (r *PostgreSqlReconciler) GetGCPCredentialsFromSecret(secretList kubeApiV1.SecretList, namespace string, ctx context.Context, instance *sqlv1alpha1.PostgreSql, dir string) error {
-	var filePath string
+//PostgreSqlsOfProviderConfig return the PostgreSqls referencing the ProviderConfig, reconciled when it changes
+func (r *PostgreSqlReconciler) PostgreSqlsOfProviderConfig(obj handler.MapObject) []reconcile.Request {
+	list := &sqlv1alpha1.PostgreSqlList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "unable to list the PostgreSqls of ProviderConfig", "providerConfig", obj.Meta.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, item := range list.Items {
+		if item.Spec.ProviderConfigRef != nil && item.Spec.ProviderConfigRef.Name == obj.Meta.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: item.Namespace, Name: item.Name}})
+		}
+	}
+	return requests
+}
+
+//ResolveProviderConfig complete the spec of the instance with the ProviderConfig it references
+func (r *PostgreSqlReconciler) ResolveProviderConfig(ctx context.Context, instance *sqlv1alpha1.PostgreSql) error {
+	if instance.Spec.ProviderConfigRef == nil {
+		instance.SetProjectDefaults()
+		return nil
+	}
+	config := &sqlv1alpha1.ProviderConfig{}
+	err := r.Get(ctx, client.ObjectKey{Name: instance.Spec.ProviderConfigRef.Name}, config)
+	if err != nil {
+		return err
+	}
+	instance.ResolveProviderConfig(config)
+	return nil
+}
+
+//SetProviderConfigNotFound record in the ProviderConfigNotFound condition whether the ProviderConfig failed to be
+//read with err, and return whether the condition changed
+func SetProviderConfigNotFound(instance *sqlv1alpha1.PostgreSql, err error) bool {
+	c := util.GetCondition(instance.Status.Conditions, sqlv1alpha1.ConditionProviderConfigNotFound)
+	if err == nil {
+		if c == nil || c.Status == kubeApiV1.ConditionFalse {
+			return false
+		}
+		util.SetCondition(&instance.Status.Conditions, sqlv1alpha1.PostgreSqlCondition{
+			Type:    sqlv1alpha1.ConditionProviderConfigNotFound,
+			Status:  kubeApiV1.ConditionFalse,
+			Reason:  "Resolved",
+			Message: "the ProviderConfig has been resolved",
+		})
+		return true
+	}
+	util.SetCondition(&instance.Status.Conditions, sqlv1alpha1.PostgreSqlCondition{
+		Type:    sqlv1alpha1.ConditionProviderConfigNotFound,
+		Status:  kubeApiV1.ConditionTrue,
+		Reason:  "NotFound",
+		Message: fmt.Sprintf("failed to resolve ProviderConfig %q: %v", instance.Spec.ProviderConfigRef.Name, err),
+	})
+	return true
+}
+
+//AbandoningInstance remove the finalizer and the workspace of a PostgreSql being deleted without destroying its
+//cloud resources, whose states are left in their backend
+func (r *PostgreSqlReconciler) AbandoningInstance(ctx context.Context, key types.NamespacedName, instance *sqlv1alpha1.PostgreSql) (ctrl.Result, error) {
+	util.RemoveFinalizer(instance, Finalizer)
+	errC := r.Workspaces.Remove(key)
+	if errC != nil {
+		errMsg := fmt.Sprintf("failed to do houseCleaning for instance %v/%v ", instance.Namespace, instance.Name)
+		r.Log.Error(errC, errMsg)
+		return ctrl.Result{Requeue: true}, nil
+	}
+	if errU := r.UpdateFinalizers(ctx, instance); errU != nil {
+		return ctrl.Result{}, errU
+	}
+	r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "Abandoned", "cloud sql instance %q is left behind, its ProviderConfig %q is missing", instance.Spec.SqlInstance.Name, instance.Spec.ProviderConfigRef.Name)
+	return ctrl.Result{}, nil
+}
+
+//UpdateFinalizers save the finalizers of the instance alone, as its spec may have been completed by the ProviderConfig
+func (r *PostgreSqlReconciler) UpdateFinalizers(ctx context.Context, instance *sqlv1alpha1.PostgreSql) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      instance.Finalizers,
+			"resourceVersion": instance.ResourceVersion,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	patched := instance.DeepCopy()
+	err = r.Patch(ctx, patched, client.RawPatch(types.MergePatchType, data))
+	if err != nil {
+		return err
+	}
+	instance.ResourceVersion = patched.ResourceVersion
+	return nil
+}
+
+//ConsumeAnnotation remove a confirmation annotation once it has been acted upon, e.g. the approve-plan annotation
+//once the plan is applied, so that it does not confirm a later change
+func (r *PostgreSqlReconciler) ConsumeAnnotation(ctx context.Context, instance *sqlv1alpha1.PostgreSql, annotation string) error {
+	if _, ok := instance.GetAnnotations()[annotation]; !ok {
+		return nil
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations":     map[string]interface{}{annotation: nil},
+			"resourceVersion": instance.ResourceVersion,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	patched := instance.DeepCopy()
+	err = r.Patch(ctx, patched, client.RawPatch(types.MergePatchType, data))
+	if err != nil {
+		return err
+	}
+	delete(instance.Annotations, annotation)
+	instance.ResourceVersion = patched.ResourceVersion
+	return nil
+}
+
+//GetTerraformEnv return the terraform environment of the instance, with the credentials of GCP and of its backend.
+//The credentials are only passed to the terraform runs, they are never written to the workspace
+func (r *PostgreSqlReconciler) GetTerraformEnv(secretList kubeApiV1.SecretList, namespace string, ctx context.Context, instance *sqlv1alpha1.PostgreSql, dir string) ([]string, error) {
+	if err := WipeCredentialFiles(dir); err != nil {
+		return nil, err
+	}
+	env, err := r.GetGCPCredentialsFromSecret(secretList, namespace, ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	backendEnv, err := r.GetS3CredentialsFromSecret(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := r.GetStateEndpoint(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint != nil {
+		backendEnv = append(backendEnv, endpoint.Env()...)
+	}
+	return append(env, backendEnv...), nil
+}
+
+//GetS3CredentialsFromSecret fetch the access keys of the s3 backend, and return them as terraform environment
+func (r *PostgreSqlReconciler) GetS3CredentialsFromSecret(ctx context.Context, instance *sqlv1alpha1.PostgreSql) ([]string, error) {
+	s3 := instance.Spec.RemoteState.S3
+	if instance.Spec.RemoteState.GetType() != sqlv1alpha1.BackendS3 || s3 == nil {
+		return nil, nil
+	}
+	ref := s3.CredentialsSecretRef
+	keys := map[string]string{
+		"AWS_ACCESS_KEY_ID":     ref.AccessKeyIDKey,
+		"AWS_SECRET_ACCESS_KEY": ref.SecretAccessKeyKey,
+	}
+	secret := &kubeApiV1.Secret{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: ref.Name}, secret)
+	if err != nil {
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "KeyNotFound", "unable to find the s3 credentials secret %q", ref.Name)
+		return nil, fmt.Errorf("s3 credentials secret %v does not exist in namespace %v - error %v", ref.Name, instance.Namespace, err)
+	}
+	var env []string
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		key := keys[name]
+		if key == "" {
+			key = name
+		}
+		value, ok := secret.Data[key]
+		if !ok || len(value) == 0 {
+			r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "KeyNotFound", "unable to find secret key %q in the s3 credentials secret %q", key, ref.Name)
+			return nil, fmt.Errorf("secret key %q/%q does not exist", ref.Name, key)
+		}
+		env = append(env, name+"="+string(value))
+	}
+	return env, nil
+}
+
+//GetGCPCredentialsFromSecret fetch gcp serviceAccount from the credentials secret, and return the terraform environment using it.
+//Without credentials, the json keys of every secret of the namespace are used, the last one wins
+func (r *PostgreSqlReconciler) GetGCPCredentialsFromSecret(secretList kubeApiV1.SecretList, namespace string, ctx context.Context, instance *sqlv1alpha1.PostgreSql) ([]string, error) {
+	deprecated := instance.Spec.Project.GetAuthMode() != sqlv1alpha1.AuthWorkloadIdentity && instance.Spec.Project.Credentials == nil
+	r.SetDeprecatedCredentials(ctx, instance, deprecated)
+	if instance.Spec.Project.GetAuthMode() == sqlv1alpha1.AuthWorkloadIdentity {
+		// terraform uses the ambient credentials of the operator
+		return nil, nil
+	}
+	if instance.Spec.Project.Credentials != nil {
+		return r.GetCredentialsFromSecretKeyRef(ctx, instance)
+	}
+	var env []string
 	err := r.List(ctx, &secretList, client.InNamespace(namespace))
 	if err != nil {
 		errMsg := fmt.Sprintf("unable to list secret in namespace  %v", instance.Namespace)
@@ -228,22 +683,189 @@ func (r *PostgreSqlReconciler) GetGCPCredentialsFromSecret(secretList kubeApiV1.
 			}
 			isFound = true
 			value := k.Data[obj]
-			filePath = filepath.Join(dir + "/" + obj)
 			if len(value) != 0 {
-				if err := ioutil.WriteFile(filePath, value, 0600); err != nil {
-					return fmt.Errorf("failed to write serviceAccount json key to file %v", err)
-				}
-				os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filePath)
+				env = []string{credentialsEnv + "=" + string(value)}
 			}
 		}
 	}
 	if !isFound {
 		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "KeyNotFound", "unable to find valid GCP serviceAccount json key in namespace %q", namespace)
-		return fmt.Errorf("json secret key not found in namespace %v", namespace)
+		return nil, fmt.Errorf("json secret key not found in namespace %v", namespace)
+	}
+	return env, nil
+}
+
+//SetDeprecatedCredentials record in the DeprecatedCredentials condition whether the credentials fall back to the
+//json keys of the namespace, the warning event is only emitted when the fallback starts
+func (r *PostgreSqlReconciler) SetDeprecatedCredentials(ctx context.Context, instance *sqlv1alpha1.PostgreSql, deprecated bool) {
+	c := util.GetCondition(instance.Status.Conditions, sqlv1alpha1.ConditionDeprecatedCredentials)
+	if deprecated == (c != nil && c.Status == kubeApiV1.ConditionTrue) {
+		return
+	}
+	condition := sqlv1alpha1.PostgreSqlCondition{
+		Type:    sqlv1alpha1.ConditionDeprecatedCredentials,
+		Status:  kubeApiV1.ConditionFalse,
+		Reason:  "CredentialsSet",
+		Message: "the credentials are set in the spec",
+	}
+	if deprecated {
+		condition.Status = kubeApiV1.ConditionTrue
+		condition.Reason = "NamespaceJSONKeys"
+		condition.Message = fmt.Sprintf("no credentials.secretKeyRef is set, falling back to the json keys of the secrets of namespace %q", instance.Namespace)
+		r.Recorder.Event(instance, kubeApiV1.EventTypeWarning, "DeprecatedCredentials", condition.Message)
+	} else if c == nil {
+		return
+	}
+	util.SetCondition(&instance.Status.Conditions, condition)
+	_ = r.UpdateStatus(ctx, instance, instance.Status.Phase)
+}
+
+//GetCredentialsFromSecretKeyRef fetch the gcp serviceAccount json key selected by credentials.secretKeyRef, and return the
+//terraform environment using it
+func (r *PostgreSqlReconciler) GetCredentialsFromSecretKeyRef(ctx context.Context, instance *sqlv1alpha1.PostgreSql) ([]string, error) {
+	ref := instance.Spec.Project.Credentials.SecretKeyRef
+	secret := &kubeApiV1.Secret{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: ref.Name}, secret)
+	if err != nil {
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "KeyNotFound", "unable to find the credentials secret %q", ref.Name)
+		return nil, fmt.Errorf("credentials secret %v does not exist in namespace %v - error %v", ref.Name, instance.Namespace, err)
+	}
+	value, ok := secret.Data[ref.Key]
+	if !ok || len(value) == 0 {
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "KeyNotFound", "unable to find secret key %q in the credentials secret %q", ref.Key, ref.Name)
+		return nil, fmt.Errorf("secret key %q/%q does not exist", ref.Name, ref.Key)
+	}
+	return []string{credentialsEnv + "=" + string(value)}, nil
+}
+
+//WipeCredentialFiles remove the serviceAccount json keys written at the root of the workspace by the previous versions,
+//which passed them to terraform through GOOGLE_APPLICATION_CREDENTIALS
+func WipeCredentialFiles(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Mode().IsRegular() && strings.HasSuffix(f.Name(), ".json") {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//UnprotectingInstance apply the instance without its deletion protection, so that it can be destroyed
+func (r *PostgreSqlReconciler) UnprotectingInstance(ctx context.Context, dir string, env []string, instance *sqlv1alpha1.PostgreSql) error {
+	unprotected := instance.DeepCopy()
+	unprotected.Spec.SqlInstance.DeletionProtection = false
+	b, err := r.FetchUserPasswordFromSecret(instance.Namespace, instance, ctx, secretList)
+	if err != nil {
+		return err
+	}
+	endpoint, err := r.GetStateEndpoint(ctx, instance)
+	if err != nil {
+		return err
+	}
+	err = r.GenerateTFFromCR(unprotected, dir, b, endpoint)
+	if err != nil {
+		return err
+	}
+	err = terraform.Apply(ctx, r.Executor, filepath.Join(dir, "instance"), append(env, terraform.PasswordEnv(instance, b)...))
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to disable the deletion protection of instance %v/%v", instance.Namespace, instance.Name)
+		r.Log.Error(err, errMsg)
+		failure := SetFailure(instance, err)
+		_ = r.UpdateStatus(ctx, instance, instance.Status.Phase)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "UnprotectFailed", "failed to disable the deletion protection of cloud sql instance %q: %v", instance.Spec.SqlInstance.Name, failure.Message)
+		return err
+	}
+	r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "Unprotected", "deletion protection of cloud sql instance %q disabled", instance.Spec.SqlInstance.Name)
+	return nil
+}
+
+//ExportingState export the states of the modules to a Secret, from which they can be recovered
+//once the PostgreSql is deleted
+func (r *PostgreSqlReconciler) ExportingState(ctx context.Context, dir string, env []string, instance *sqlv1alpha1.PostgreSql, modules ...string) error {
+	secret := &kubeApiV1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      StateExportName(instance),
+			Namespace: r.StateExportNamespace,
+			Annotations: map[string]string{
+				StateExportAnnotation: instance.Namespace + "/" + instance.Name,
+			},
+		},
+		Data: make(map[string][]byte),
+	}
+	if secret.Namespace == "" {
+		secret.Namespace = instance.Namespace
+	}
+	for _, module := range modules {
+		state, err := terraform.StatePull(ctx, r.Executor, filepath.Join(dir, module), env)
+		if err != nil {
+			errMsg := fmt.Sprintf("failed to export the %v state of instance %v/%v", module, instance.Namespace, instance.Name)
+			r.Log.Error(err, errMsg)
+			r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "ExportFailed", "failed to export the %s state: %v", module, terraform.Classify(err).Message)
+			return err
+		}
+		secret.Data[module+".tfstate"] = state
 	}
+	err := r.Create(ctx, secret)
+	if errors.IsAlreadyExists(err) {
+		// Export the states again, e.g. after a failed deletion
+		existing := &kubeApiV1.Secret{}
+		if err = r.Get(ctx, client.ObjectKey{Namespace: secret.Namespace, Name: secret.Name}, existing); err == nil {
+			existing.Annotations = secret.Annotations
+			existing.Data = secret.Data
+			err = r.Update(ctx, existing)
+		}
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to save the exported state of instance %v/%v", instance.Namespace, instance.Name)
+		r.Log.Error(err, errMsg)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "ExportFailed", "failed to save the state to secret %s/%s", secret.Namespace, secret.Name)
+		return err
+	}
+	r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "StateExported", "%s state exported to secret %s/%s", strings.Join(modules, ", "), secret.Namespace, secret.Name)
 	return nil
 }
 
+//StateExportName return the name of the Secret holding the exported states of the instance, the hash of
+//namespace/name tells apart the PostgreSqls whose namespace and name join the same way, e.g. a-b/c and a/b-c
+func StateExportName(instance *sqlv1alpha1.PostgreSql) string {
+	sum := sha256.Sum256([]byte(instance.Namespace + "/" + instance.Name))
+	return "tfstate-" + instance.Namespace + "-" + instance.Name + "-" + hex.EncodeToString(sum[:])[:8]
+}
+
+//GetSecretVersions return the resource versions of the password and serviceAccount secrets of the instance
+func (r *PostgreSqlReconciler) GetSecretVersions(ctx context.Context, namespace string, instance *sqlv1alpha1.PostgreSql) ([]string, error) {
+	secrets := &kubeApiV1.SecretList{}
+	err := r.List(ctx, secrets, client.InNamespace(namespace))
+	if err != nil {
+		errMsg := fmt.Sprintf("unable to list secret in namespace %v", instance.Namespace)
+		r.Log.Error(err, errMsg)
+		return nil, err
+	}
+	passwords := GetSecretFromCR(instance)
+	credentials := instance.Spec.Project.Credentials
+	scan := credentials == nil && instance.Spec.Project.GetAuthMode() != sqlv1alpha1.AuthWorkloadIdentity
+	var versions []string
+	for _, k := range secrets.Items {
+		_, referenced := passwords[k.Name]
+		if credentials != nil {
+			referenced = referenced || k.Name == credentials.SecretKeyRef.Name
+		}
+		for obj := range k.Data {
+			referenced = referenced || (scan && strings.Contains(obj, ".json"))
+		}
+		if referenced {
+			versions = append(versions, k.Name+"="+k.ResourceVersion)
+		}
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
 //FetchUserPasswordFromSecret fetch secret from namespace based on CR
 func (r *PostgreSqlReconciler) FetchUserPasswordFromSecret(namespace string, instance *sqlv1alpha1.PostgreSql, ctx context.Context, secretList kubeApiV1.SecretList) (map[string][]byte, error) {
 	secretCred := make(map[string][]byte)
@@ -296,14 +918,16 @@ func (r *PostgreSqlReconciler) UpdateStatus(ctx context.Context, instance *sqlv1
 }
 
 //GenerateTFFromCR generate tf files from CR
-func (r *PostgreSqlReconciler) GenerateTFFromCR(instance *sqlv1alpha1.PostgreSql, dir string, value map[string][]byte) error {
+func (r *PostgreSqlReconciler) GenerateTFFromCR(instance *sqlv1alpha1.PostgreSql, dir string, value map[string][]byte, endpoint *terraform.StateEndpoint) error {
 	errMsg := fmt.Sprintf("failed to generate tf files  %v/%v", instance.Name, instance.Namespace)
-	errB := terraform.GenerateBucketTF(instance, filepath.Join(dir, "bucket"))
-	if errB != nil {
-		r.Log.Error(errB, errMsg)
-		return errB
+	if UsesStateBucket(instance) {
+		errB := terraform.GenerateBucketTF(instance, filepath.Join(dir, "bucket"))
+		if errB != nil {
+			r.Log.Error(errB, errMsg)
+			return errB
+		}
 	}
-	errP := terraform.GenerateProviderAndBackendTF(instance, filepath.Join(dir, "instance"))
+	errP := terraform.GenerateProviderAndBackendTF(instance, filepath.Join(dir, "instance"), endpoint)
 	if errP != nil {
 		r.Log.Error(errP, errMsg)
 		return errP
@@ -322,26 +946,41 @@ func (r *PostgreSqlReconciler) GenerateTFFromCR(instance *sqlv1alpha1.PostgreSql
 }
 
 //ProvisioningStorageBucket provision storage bucket based on generated tf
-func (r *PostgreSqlReconciler) ProvisioningStorageBucket(dir string, bucket *sqlv1alpha1.PostgreSql, ctx context.Context) error {
-	err := terraform.Init(filepath.Join(dir, "bucket"))
+func (r *PostgreSqlReconciler) ProvisioningStorageBucket(dir string, env []string, bucket *sqlv1alpha1.PostgreSql, ctx context.Context) error {
+	err := terraform.Init(ctx, r.Executor, filepath.Join(dir, "bucket"), env)
 	if err != nil {
 		initMsg := fmt.Sprintf("initializing storage bucket failed %v", bucket.Spec.BucketConfig.Name)
 		r.Log.Error(err, initMsg)
 
+		failure := SetFailure(bucket, err)
 		errUp := r.UpdateStatus(ctx, bucket, sqlv1alpha1.PhaseFailed)
-		r.Recorder.Eventf(bucket, kubeApiV1.EventTypeWarning, "InitializeFailed ", "failed to initialize storage bucket %q", bucket.Spec.BucketConfig.Name)
+		r.Recorder.Eventf(bucket, kubeApiV1.EventTypeWarning, "InitializeFailed ", "failed to initialize storage bucket %q: %v", bucket.Spec.BucketConfig.Name, failure.Message)
 		if errUp != nil {
 			return errUp
 		}
 		return err
 	}
-	err = terraform.Apply(filepath.Join(dir, "bucket"))
+	err = r.ImportingStorageBucket(ctx, dir, env, bucket)
+	if err != nil {
+		importMsg := fmt.Sprintf("importing storage bucket failed %v", bucket.Spec.BucketConfig.Name)
+		r.Log.Error(err, importMsg)
+
+		failure := SetFailure(bucket, err)
+		errUp := r.UpdateStatus(ctx, bucket, sqlv1alpha1.PhaseFailed)
+		r.Recorder.Eventf(bucket, kubeApiV1.EventTypeWarning, "ImportFailed", "failed to import the existing storage bucket %q: %v", bucket.Spec.BucketConfig.Name, failure.Message)
+		if errUp != nil {
+			return errUp
+		}
+		return err
+	}
+	err = terraform.Apply(ctx, r.Executor, filepath.Join(dir, "bucket"), env)
 	if err != nil {
 		applyMsg := fmt.Sprintf("provisioning storage bucket failed %v", bucket.Spec.BucketConfig.Name)
 		r.Log.Error(err, applyMsg)
+		failure := SetFailure(bucket, err)
 		errUp := r.UpdateStatus(ctx, bucket, sqlv1alpha1.PhaseFailed)
 
-		r.Recorder.Eventf(bucket, kubeApiV1.EventTypeWarning, "ApplyingFailed ", "failed to provision storage bucket %q - bucket names must be unique", bucket.Spec.BucketConfig.Name)
+		r.Recorder.Eventf(bucket, kubeApiV1.EventTypeWarning, "ApplyingFailed ", "failed to provision storage bucket %q - bucket names must be unique: %v", bucket.Spec.BucketConfig.Name, failure.Message)
 		if errUp != nil {
 			return errUp
 		}
@@ -350,15 +989,100 @@ func (r *PostgreSqlReconciler) ProvisioningStorageBucket(dir string, bucket *sql
 	return nil
 }
 
+//ImportingStorageBucket import the storage bucket when it already exists, e.g. when it holds the states of other PostgreSqls
+func (r *PostgreSqlReconciler) ImportingStorageBucket(ctx context.Context, dir string, env []string, instance *sqlv1alpha1.PostgreSql) error {
+	imp := terraform.BucketImport(instance)
+	state, err := terraform.StateList(ctx, r.Executor, filepath.Join(dir, "bucket"), env)
+	if err != nil {
+		return err
+	}
+	for _, address := range state {
+		if address == imp.Address {
+			return nil
+		}
+	}
+	err = terraform.ImportResource(ctx, r.Executor, filepath.Join(dir, "bucket"), env, imp)
+	if terraform.IsNotFoundImport(err) {
+		// The bucket does not exist yet, it will be created
+		return nil
+	}
+	return err
+}
+
+//GetStateBucketUsers return the other PostgreSqls storing their state in the bucket of the instance, including the ones being deleted
+func (r *PostgreSqlReconciler) GetStateBucketUsers(ctx context.Context, instance *sqlv1alpha1.PostgreSql) ([]string, error) {
+	instances := &sqlv1alpha1.PostgreSqlList{}
+	err := r.List(ctx, instances)
+	if err != nil {
+		r.Log.Error(err, "unable to list PostgreSql")
+		return nil, err
+	}
+	var users []string
+	for _, k := range instances.Items {
+		if k.Namespace == instance.Namespace && k.Name == instance.Name {
+			continue
+		}
+		// A PostgreSql whose ProviderConfig cannot be read may use the bucket
+		if err := r.ResolveProviderConfig(ctx, &k); err != nil {
+			users = append(users, k.Namespace+"/"+k.Name)
+			continue
+		}
+		if !UsesStateBucket(&k) || k.Spec.RemoteState.BucketName != instance.Spec.RemoteState.BucketName {
+			continue
+		}
+		users = append(users, k.Namespace+"/"+k.Name)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+//GetDestroyedModules return the modules destroyed with the instance, the state bucket is only destroyed when
+//its deletion is allowed and no other PostgreSql uses it
+func (r *PostgreSqlReconciler) GetDestroyedModules(ctx context.Context, instance *sqlv1alpha1.PostgreSql) ([]string, error) {
+	if !UsesStateBucket(instance) {
+		return []string{"instance"}, nil
+	}
+	users, err := r.GetStateBucketUsers(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	bucket := instance.Spec.RemoteState.BucketName
+	switch {
+	case len(users) > 0:
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "StateBucketRetained", "state bucket %q is retained, it is still used by %v", bucket, strings.Join(users, ", "))
+	case !instance.Spec.BucketConfig.GetDestroy():
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "StateBucketRetained", "state bucket %q is retained, its deletion is not allowed by bucketConfig.destroy", bucket)
+	default:
+		return []string{"instance", "bucket"}, nil
+	}
+	return []string{"instance"}, nil
+}
+
+//DeletingStateSecrets delete the Secrets of the kubernetes backend once the instance is destroyed
+func (r *PostgreSqlReconciler) DeletingStateSecrets(ctx context.Context, instance *sqlv1alpha1.PostgreSql) error {
+	if instance.Spec.RemoteState.GetType() != sqlv1alpha1.BackendKubernetes {
+		return nil
+	}
+	err := r.DeleteAllOf(ctx, &kubeApiV1.Secret{}, client.InNamespace(instance.Namespace),
+		client.MatchingLabels{terraform.StateLabel: instance.Name})
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to delete the state secrets of instance %v/%v", instance.Namespace, instance.Name)
+		r.Log.Error(err, errMsg)
+		return err
+	}
+	return nil
+}
+
 //InitializeRemoteBackend initialize remote backend based on generated tf
-func (r *PostgreSqlReconciler) InitializeRemoteBackend(dir string, instance *sqlv1alpha1.PostgreSql, ctx context.Context) error {
-	err := terraform.Init(filepath.Join(dir, "instance"))
+func (r *PostgreSqlReconciler) InitializeRemoteBackend(dir string, env []string, instance *sqlv1alpha1.PostgreSql, ctx context.Context) error {
+	err := terraform.Init(ctx, r.Executor, filepath.Join(dir, "instance"), env)
 	if err != nil {
 		errMsg := fmt.Sprintf("initializing remote backend failed for instance %v/%v", instance.Name, instance.Namespace)
 		r.Log.Error(err, errMsg)
 
+		failure := SetFailure(instance, err)
 		errUp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseFailed)
-		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "InitializeFailed ", "failed to initialize remote backend %q", instance.Spec.RemoteState.BucketName)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "InitializeFailed ", "failed to initialize remote backend %q: %v", instance.Spec.RemoteState.GetType(), failure.Message)
 		if errUp != nil {
 			return errUp
 		}
@@ -367,15 +1091,305 @@ func (r *PostgreSqlReconciler) InitializeRemoteBackend(dir string, instance *sql
 	return nil
 }
 
-//ProvisioningInstance provision sql instance based on generated tf
-func (r *PostgreSqlReconciler) ProvisioningInstance(dir string, instance *sqlv1alpha1.PostgreSql, ctx context.Context) error {
-	err := terraform.Apply(filepath.Join(dir, "instance"))
+//MigratingState copy the state of the instance from the backend the workspace is initialized with to its
+//new remoteState, then initialize the workspace with the new remoteState. The copy is made in a migration
+//module, so that a failed migration is run again from the previous backend, and must hold the same
+//resources at the same serial as the previous state.
+func (r *PostgreSqlReconciler) MigratingState(dir string, env []string, instance *sqlv1alpha1.PostgreSql, location string, ctx context.Context) error {
+	migration := &sqlv1alpha1.PostgreSqlStateMigration{From: instance.Status.StateLocation, To: location}
+	summary, err := r.migrateState(ctx, dir, env)
+	if err != nil {
+		errMsg := fmt.Sprintf("migrating the state of instance %v/%v failed", instance.Name, instance.Namespace)
+		r.Log.Error(err, errMsg)
+
+		failure := SetFailure(instance, err)
+		errUp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseFailed)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "StateMigrationFailed", "failed to migrate the terraform state from %s to %s: %v", migration.From, migration.To, failure.Message)
+		if errUp != nil {
+			return errUp
+		}
+		return err
+	}
+	migration.Serial = summary.Serial
+	migration.Resources = summary.Resources
+	migration.Time = metav1.Now()
+	instance.Status.StateMigration = migration
+	r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "StateMigrated", "migrated the terraform state from %s to %s: %v", migration.From, migration.To, summary)
+	return r.InitializeRemoteBackend(dir, env, instance, ctx)
+}
+
+func (r *PostgreSqlReconciler) migrateState(ctx context.Context, dir string, env []string) (*terraform.StateSummary, error) {
+	backend, err := terraform.ReadInitializedBackend(filepath.Join(dir, "instance"))
+	if err != nil {
+		return nil, err
+	}
+	if backend == nil {
+		return nil, fmt.Errorf("the workspace is not initialized with the previous backend anymore")
+	}
+	module := filepath.Join(dir, "migration")
+	if err = os.RemoveAll(module); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(module)
+	if err = os.MkdirAll(module, 0700); err != nil {
+		return nil, err
+	}
+	if err = terraform.GenerateInitializedBackendTF(backend, module); err != nil {
+		return nil, err
+	}
+	if err = terraform.Init(ctx, r.Executor, module, env); err != nil {
+		return nil, err
+	}
+	before, err := r.summarizeState(ctx, module, env)
 	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "instance", "backend.tf.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err = util.WriteToFile(b, module, "backend.tf.json"); err != nil {
+		return nil, err
+	}
+	if err = terraform.MigrateState(ctx, r.Executor, module, env); err != nil {
+		return nil, err
+	}
+	after, err := r.summarizeState(ctx, module, env)
+	if err != nil {
+		return nil, err
+	}
+	if after.Serial != before.Serial || after.Resources != before.Resources {
+		return nil, fmt.Errorf("the migrated state holds %v while the previous state holds %v", after, before)
+	}
+	return after, nil
+}
+
+func (r *PostgreSqlReconciler) summarizeState(ctx context.Context, dir string, env []string) (*terraform.StateSummary, error) {
+	b, err := terraform.StatePull(ctx, r.Executor, dir, env)
+	if err != nil {
+		return nil, err
+	}
+	return terraform.SummarizeState(b)
+}
+
+//PlanningInstance save the sql instance plan and record its summary on the CR
+func (r *PostgreSqlReconciler) PlanningInstance(dir string, env []string, instance *sqlv1alpha1.PostgreSql, ctx context.Context) (*terraform.Plan, error) {
+	err := terraform.CreatePlan(ctx, r.Executor, filepath.Join(dir, "instance"), env)
+	if err != nil {
+		if r.IsStateLocked(ctx, dir, env, instance, err) {
+			return nil, err
+		}
+		return nil, r.planningFailed(ctx, instance, err)
+	}
+	plan, err := terraform.ShowPlan(ctx, r.Executor, filepath.Join(dir, "instance"), env)
+	if err != nil {
+		_ = terraform.RemovePlan(filepath.Join(dir, "instance"))
+		return nil, r.planningFailed(ctx, instance, err)
+	}
+	if !plan.HasChanges() {
+		// Only a plan about to be applied is kept in the workspace
+		if err := terraform.RemovePlan(filepath.Join(dir, "instance")); err != nil {
+			return nil, err
+		}
+	}
+	instance.Status.Plan = &sqlv1alpha1.PostgresInstancePlan{
+		Add:       plan.Add,
+		Change:    plan.Change,
+		Destroy:   plan.Destroy,
+		Resources: plan.Resources,
+		Hash:      plan.Hash,
+	}
+	ClearStateLock(instance)
+	errUp := r.UpdateStatus(ctx, instance, instance.Status.Phase)
+	if errUp != nil {
+		return nil, errUp
+	}
+	r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "Planned", "plan for cloud sql instance %q: %v", instance.Name, plan)
+	return plan, nil
+}
+
+func (r *PostgreSqlReconciler) planningFailed(ctx context.Context, instance *sqlv1alpha1.PostgreSql, err error) error {
+	errMsg := fmt.Sprintf("planning sql instance  %v/%v failed", instance.Name, instance.Namespace)
+	r.Log.Error(err, errMsg)
+
+	failure := SetFailure(instance, err)
+	errUp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseFailed)
+	r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "PlanningFailed", "failed to plan cloud sql instance %q: %v", instance.Name, failure.Message)
+	if errUp != nil {
+		return errUp
+	}
+	return err
+}
+
+//GetDriftCheckInterval return the period between two drift checks of the instance, zero when disabled
+func (r *PostgreSqlReconciler) GetDriftCheckInterval(instance *sqlv1alpha1.PostgreSql) time.Duration {
+	if instance.Spec.DriftCheckInterval != nil {
+		return instance.Spec.DriftCheckInterval.Duration
+	}
+	return r.DriftCheckInterval
+}
+
+//DetectingDrift compare the sql instance with its configuration and record the result in the Drifted condition
+func (r *PostgreSqlReconciler) DetectingDrift(dir string, env []string, instance *sqlv1alpha1.PostgreSql, ctx context.Context) (bool, error) {
+	plan, err := terraform.DetectDrift(ctx, r.Executor, filepath.Join(dir, "instance"), env)
+	if err != nil {
+		if r.IsStateLocked(ctx, dir, env, instance, err) {
+			return false, err
+		}
+		errMsg := fmt.Sprintf("drift detection failed for instance %v/%v", instance.Name, instance.Namespace)
+		r.Log.Error(err, errMsg)
+		failure := SetFailure(instance, err)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "DriftCheckFailed", "failed to check cloud sql instance %q for drifts: %v", instance.Name, failure.Message)
+		if errUp := r.UpdateStatus(ctx, instance, instance.Status.Phase); errUp != nil {
+			return false, errUp
+		}
+		return false, err
+	}
+	condition := sqlv1alpha1.PostgreSqlCondition{
+		Type:    sqlv1alpha1.ConditionDrifted,
+		Status:  kubeApiV1.ConditionFalse,
+		Reason:  "NoDrift",
+		Message: "cloud sql instance matches the PostgreSql spec",
+	}
+	if plan != nil && plan.HasChanges() {
+		condition.Status = kubeApiV1.ConditionTrue
+		condition.Reason = "DriftDetected"
+		condition.Message = fmt.Sprintf("%v, drifted resources: %v", plan, strings.Join(plan.Resources, ", "))
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "Drifted", "cloud sql instance %q drifted from its spec: %v", instance.Name, condition.Message)
+	}
+	util.SetCondition(&instance.Status.Conditions, condition)
+	CompleteStage(instance, sqlv1alpha1.StageDriftCheck)
+	ClearStateLock(instance)
+	ClearFailure(instance)
+	errUp := r.UpdateStatus(ctx, instance, instance.Status.Phase)
+	if errUp != nil {
+		return false, errUp
+	}
+	return condition.Status == kubeApiV1.ConditionTrue, nil
+}
+
+//IsStateLocked check whether err is caused by a terraform state lock and records it in the StateLocked condition.
+//The lock is force-unlocked once its ID has been confirmed with the force-unlock annotation
+func (r *PostgreSqlReconciler) IsStateLocked(ctx context.Context, dir string, env []string, instance *sqlv1alpha1.PostgreSql, err error) bool {
+	lock, ok := terraform.ParseLockError(err)
+	if !ok {
+		return false
+	}
+	condition := sqlv1alpha1.PostgreSqlCondition{
+		Type:    sqlv1alpha1.ConditionStateLocked,
+		Status:  kubeApiV1.ConditionTrue,
+		Reason:  "LockHeld",
+		Message: fmt.Sprintf("state locked by %q since %v for %v, lock ID %q", lock.Who, lock.Created, lock.Operation, lock.ID),
+	}
+	if instance.GetAnnotations()[sqlv1alpha1.ForceUnlockAnnotation] != lock.ID {
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "StateLocked", "%s, once the holder is gone annotate the instance with %s=%s to force-unlock it", condition.Message, sqlv1alpha1.ForceUnlockAnnotation, lock.ID)
+	} else if errU := terraform.ForceUnlock(ctx, r.Executor, filepath.Join(dir, "instance"), env, lock.ID); errU != nil {
+		errMsg := fmt.Sprintf("failed to force-unlock the state of instance %v/%v", instance.Name, instance.Namespace)
+		r.Log.Error(errU, errMsg)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "ForceUnlockFailed", "failed to force-unlock lock %q", lock.ID)
+	} else {
+		condition.Status = kubeApiV1.ConditionFalse
+		condition.Reason = "ForceUnlocked"
+		condition.Message = fmt.Sprintf("lock %q held by %q has been force-unlocked", lock.ID, lock.Who)
+		r.Recorder.Event(instance, kubeApiV1.EventTypeNormal, "ForceUnlocked", condition.Message)
+	}
+	util.SetCondition(&instance.Status.Conditions, condition)
+	_ = r.UpdateStatus(ctx, instance, instance.Status.Phase)
+	return true
+}
+
+//ClearStateLock mark the state as unlocked after a successful run
+func ClearStateLock(instance *sqlv1alpha1.PostgreSql) {
+	if c := util.GetCondition(instance.Status.Conditions, sqlv1alpha1.ConditionStateLocked); c != nil && c.Status == kubeApiV1.ConditionTrue {
+		util.SetCondition(&instance.Status.Conditions, sqlv1alpha1.PostgreSqlCondition{
+			Type:    sqlv1alpha1.ConditionStateLocked,
+			Status:  kubeApiV1.ConditionFalse,
+			Reason:  "Unlocked",
+			Message: "state lock has been released",
+		})
+	}
+}
+
+//AdoptingInstance import the existing cloud resources named in the spec which are not in the state yet
+func (r *PostgreSqlReconciler) AdoptingInstance(dir string, env []string, instance *sqlv1alpha1.PostgreSql, ctx context.Context) error {
+	state, err := terraform.StateList(ctx, r.Executor, filepath.Join(dir, "instance"), env)
+	if err != nil {
+		return r.adoptingFailed(ctx, instance, err)
+	}
+	inState := make(map[string]bool)
+	for _, address := range state {
+		inState[address] = true
+	}
+	for _, imp := range terraform.InstanceImports(instance) {
+		if inState[imp.Address] {
+			continue
+		}
+		err := terraform.ImportResource(ctx, r.Executor, filepath.Join(dir, "instance"), env, imp)
+		if terraform.IsNotFoundImport(err) {
+			// The resource does not exist yet, the plan will create it
+			r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "NothingToAdopt", "%s %q does not exist, it will be created", imp.Address, imp.ID)
+			continue
+		}
+		if err != nil {
+			if r.IsStateLocked(ctx, dir, env, instance, err) {
+				return err
+			}
+			return r.adoptingFailed(ctx, instance, err)
+		}
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "Adopted", "imported existing %s %q", imp.Address, imp.ID)
+	}
+	return nil
+}
+
+func (r *PostgreSqlReconciler) adoptingFailed(ctx context.Context, instance *sqlv1alpha1.PostgreSql, err error) error {
+	errMsg := fmt.Sprintf("adopting sql instance  %v/%v failed", instance.Name, instance.Namespace)
+	r.Log.Error(err, errMsg)
+
+	failure := SetFailure(instance, err)
+	errUp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseFailed)
+	r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "AdoptionFailed", "failed to import the existing cloud sql instance %q: %v", instance.Spec.SqlInstance.Name, failure.Message)
+	if errUp != nil {
+		return errUp
+	}
+	return err
+}
+
+//IsPlanApproved check whether the plan can be applied according to the approval mode.
+//The first plan of an adopted instance always requires an approval
+func (r *PostgreSqlReconciler) IsPlanApproved(instance *sqlv1alpha1.PostgreSql, plan *terraform.Plan) bool {
+	firstAdoption := instance.Spec.Adopt && instance.Status.ObservedGeneration == 0
+	if !firstAdoption && (instance.Spec.ApprovalMode != sqlv1alpha1.ApprovalManual || !plan.IsDestructive()) {
+		return true
+	}
+	approved, ok := instance.GetAnnotations()[sqlv1alpha1.ApprovePlanAnnotation]
+	if approved == plan.Hash {
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "PlanApproved", "plan %q approved for cloud sql instance %q", plan.Hash, instance.Name)
+		return true
+	}
+	if ok {
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "StaleApproval", "approval %q does not match the current plan %q", approved, plan.Hash)
+	}
+	if firstAdoption {
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "AwaitingApproval", "plan %q changes the adopted resources (%v), annotate the instance with %s=%s to apply it", plan.Hash, plan, sqlv1alpha1.ApprovePlanAnnotation, plan.Hash)
+		return false
+	}
+	r.Recorder.Eventf(instance, kubeApiV1.EventTypeNormal, "AwaitingApproval", "plan %q destroys or replaces resources (%v), annotate the instance with %s=%s to apply it", plan.Hash, plan, sqlv1alpha1.ApprovePlanAnnotation, plan.Hash)
+	return false
+}
+
+//ProvisioningInstance provision sql instance based on the saved plan
+func (r *PostgreSqlReconciler) ProvisioningInstance(dir string, env []string, instance *sqlv1alpha1.PostgreSql, ctx context.Context) error {
+	err := terraform.ApplyPlan(ctx, r.Executor, filepath.Join(dir, "instance"), env)
+	if err != nil {
+		if r.IsStateLocked(ctx, dir, env, instance, err) {
+			return err
+		}
 		errMsg := fmt.Sprintf("provisioning sql instance  %v/%v failed", instance.Name, instance.Namespace)
 		r.Log.Error(err, errMsg)
 
+		failure := SetFailure(instance, err)
 		errUp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseFailed)
-		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "ApplyingFailed ", "failed to provision cloud sql instance %q", instance.Name)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "ApplyingFailed ", "failed to provision cloud sql instance %q: %v", instance.Name, failure.Message)
 		if errUp != nil {
 			return errUp
 		}
@@ -384,21 +1398,94 @@ func (r *PostgreSqlReconciler) ProvisioningInstance(dir string, instance *sqlv1a
 	return nil
 }
 
+//GetStateEndpoint return the endpoint of the state of an instance using the http backend, and nil for the other backends
+func (r *PostgreSqlReconciler) GetStateEndpoint(ctx context.Context, instance *sqlv1alpha1.PostgreSql) (*terraform.StateEndpoint, error) {
+	if instance.Spec.RemoteState.GetType() != sqlv1alpha1.BackendHTTP {
+		return nil, nil
+	}
+	if r.StateBackendAddress == "" {
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "BackendUnavailable", "the http backend is not served by the manager, see --state-backend-address")
+		return nil, fmt.Errorf("the http backend is not served by the manager")
+	}
+	endpoint, err := statebackend.EnsureSecret(ctx, r.Client, r.Scheme, instance, r.StateBackendAddress)
+	r.SetStateSecretConflict(ctx, instance, err)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to create the state secret of instance %v/%v", instance.Namespace, instance.Name)
+		r.Log.Error(err, errMsg)
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+//SetStateSecretConflict record in the StateSecretConflict condition whether the state Secret of the instance is
+//owned by another object, the warning event is only emitted when the conflict starts
+func (r *PostgreSqlReconciler) SetStateSecretConflict(ctx context.Context, instance *sqlv1alpha1.PostgreSql, err error) {
+	_, conflict := err.(*statebackend.NotOwnedError)
+	if err != nil && !conflict {
+		return
+	}
+	c := util.GetCondition(instance.Status.Conditions, sqlv1alpha1.ConditionStateSecretConflict)
+	if conflict == (c != nil && c.Status == kubeApiV1.ConditionTrue) {
+		return
+	}
+	condition := sqlv1alpha1.PostgreSqlCondition{
+		Type:    sqlv1alpha1.ConditionStateSecretConflict,
+		Status:  kubeApiV1.ConditionFalse,
+		Reason:  "Owned",
+		Message: "the state secret is owned by the PostgreSql",
+	}
+	if conflict {
+		condition.Status = kubeApiV1.ConditionTrue
+		condition.Reason = "NotOwned"
+		condition.Message = fmt.Sprintf("%v, delete it or set the PostgreSql as its controller", err)
+		r.Recorder.Event(instance, kubeApiV1.EventTypeWarning, "StateSecretConflict", condition.Message)
+	} else if c == nil {
+		return
+	}
+	util.SetCondition(&instance.Status.Conditions, condition)
+	_ = r.UpdateStatus(ctx, instance, instance.Status.Phase)
+}
+
+//ReadingOutput read the outputs of the instance, from its state when it is served by the http backend
+func (r *PostgreSqlReconciler) ReadingOutput(ctx context.Context, dir string, env []string, instance *sqlv1alpha1.PostgreSql) (*sqlv1alpha1.PostgresInstanceOutput, error) {
+	if instance.Spec.RemoteState.GetType() != sqlv1alpha1.BackendHTTP {
+		return terraform.Output(ctx, r.Executor, filepath.Join(dir, "instance"), env)
+	}
+	var reader client.Reader = r.Client
+	if r.APIReader != nil {
+		reader = r.APIReader
+	}
+	state, err := statebackend.StateOf(ctx, reader, instance)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, fmt.Errorf("the state of instance %v/%v is empty", instance.Namespace, instance.Name)
+	}
+	output, err := terraform.DecodeOutput(state.Outputs)
+	if err != nil {
+		return nil, err
+	}
+	instance.Status.StateSerial = state.Serial
+	return output, nil
+}
+
 //GetOutput get output and update the output status
-func (r *PostgreSqlReconciler) GetOutput(dir string, instance *sqlv1alpha1.PostgreSql) (*sqlv1alpha1.PostgreSql, error) {
-	output, errO := terraform.Output(filepath.Join(dir, "instance"))
+func (r *PostgreSqlReconciler) GetOutput(ctx context.Context, dir string, env []string, instance *sqlv1alpha1.PostgreSql) (*sqlv1alpha1.PostgreSql, error) {
+	output, errO := r.ReadingOutput(ctx, dir, env, instance)
 	if errO != nil {
 		errMsg := fmt.Sprintf("failed to get instance %v/%v output ", instance.Name, instance.Namespace)
 		r.Log.Error(errO, errMsg)
+		failure := SetFailure(instance, errO)
+		errUp := r.UpdateStatus(ctx, instance, sqlv1alpha1.PhaseFailed)
+		r.Recorder.Eventf(instance, kubeApiV1.EventTypeWarning, "OutputFailed", "failed to read the outputs of cloud sql instance %q: %v", instance.Name, failure.Message)
+		if errUp != nil {
+			return nil, errUp
+		}
 		return nil, errO
 	}
-	errs, out := util.UpdateOutput(instance, output)
-	if errs != nil {
-		errMsg := fmt.Sprintf("failed to update instance %v/%v ", instance.Name, instance.Namespace)
-		r.Log.Error(errs, errMsg)
-		return nil, errs
-	}
-	return out, nil
+	instance.Status.Output = *output
+	return instance, nil
 }
 
 //GetSecretFromCR stores secretKeyRefs on a map
@@ -0,0 +1,1527 @@
+/*
+Copyright 2020 The Terrak8s-operator authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/HamzaZo/terrak8s-operator/pkg/statebackend"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	"github.com/HamzaZo/terrak8s-operator/pkg/util"
+	"github.com/HamzaZo/terrak8s-operator/pkg/workspace"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	kubeApiV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"os"
+	"path/filepath"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
+	"time"
+)
+
+const testOutput = `{
+  "connectionIPAddress": {"sensitive": false, "type": "string", "value": "10.0.0.3"},
+  "connectionName": {"sensitive": false, "type": "string", "value": "my-project:region-1:my-instance"}
+}`
+
+const testPlan = `{
+  "format_version": "0.1",
+  "resource_changes": [
+    {"address": "google_sql_database_instance.instance", "change": {"actions": ["create"]}},
+    {"address": "google_sql_database.database", "change": {"actions": ["create"]}},
+    {"address": "google_sql_user.default", "change": {"actions": ["no-op"]}}
+  ]
+}`
+
+const testReplacePlan = `{
+  "format_version": "0.1",
+  "resource_changes": [
+    {"address": "google_sql_database_instance.instance", "change": {"actions": ["delete", "create"]}}
+  ]
+}`
+
+const testDriftLog = `{"@level":"info","@message":"google_sql_database_instance.instance: Plan to update","type":"planned_change","change":{"resource":{"addr":"google_sql_database_instance.instance"},"action":"update"}}
+{"@level":"info","@message":"Plan: 0 to add, 1 to change, 0 to destroy.","type":"change_summary","changes":{"add":0,"change":1,"remove":0,"operation":"plan"}}`
+
+const testDriftPlan = `{
+  "format_version": "0.1",
+  "resource_changes": [
+    {"address": "google_sql_database_instance.instance", "change": {
+      "actions": ["update"],
+      "before": {"name": "my-instance", "settings": [{"tier": "db-custom-1-3840"}]},
+      "after": {"name": "my-instance", "settings": [{"tier": "db-f1-micro"}]}
+    }}
+  ]
+}`
+
+// unreadableProviderConfigClient fails to read every ProviderConfig with err
+type unreadableProviderConfigClient struct {
+	client.Client
+	err error
+}
+
+func (c unreadableProviderConfigClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if _, ok := obj.(*sqlv1alpha1.ProviderConfig); ok {
+		return c.err
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func newTestPostgreSql(namespace string) *sqlv1alpha1.PostgreSql {
+	return &sqlv1alpha1.PostgreSql{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-instance",
+			Namespace: namespace,
+		},
+		Spec: sqlv1alpha1.PostgreSqlSpec{
+			Project: sqlv1alpha1.PostgresqlInstanceProvider{
+				Name:   "my-project",
+				Region: "region-1",
+				Zone:   "zone-1",
+			},
+			RemoteState: sqlv1alpha1.PostgresqlInstanceBackend{
+				BucketName:   "my-bucket",
+				BucketPrefix: "test/tfstate",
+			},
+			BucketConfig: sqlv1alpha1.PostgresqlInstanceStorageBucket{
+				Name:         "my-bucket",
+				Project:      "my-project",
+				Location:     "region-1",
+				StorageClass: "STANDARD",
+			},
+			Databases: []sqlv1alpha1.PostgresInstanceDatabases{
+				{
+					Project:  "my-project",
+					Name:     "db",
+					Instance: "my-instance",
+				},
+			},
+			Users: []sqlv1alpha1.PostgresInstanceDatabaseUsers{
+				{
+					Name:     "user-1",
+					Project:  "my-project",
+					Instance: "my-instance",
+					Password: sqlv1alpha1.PostgresInstanceDatabasePassword{
+						SecretKeyRef: sqlv1alpha1.PostgresInstanceDatabasePasswordSpec{
+							Name: "mypassword",
+							Key:  "mykey",
+						},
+					},
+				},
+			},
+			SqlInstance: sqlv1alpha1.PostgresqlInstanceSpec{
+				DataBaseVersion: "POSTGRES_9_6",
+				Name:            "my-instance",
+				Project:         "my-project",
+				Region:          "region-1",
+				Settings: []sqlv1alpha1.PostgresInstanceSettingsSpec{
+					{
+						MachineType: "db-f1-micro",
+						IpConfiguration: sqlv1alpha1.PostgresInstanceSettingsIpConfiguration{
+							PrivateNetwork: "my-vpc",
+						},
+						BackupConfiguration: sqlv1alpha1.PostgresInstanceSettingsBackupConfiguration{
+							Enabled:   true,
+							StartTime: "21:09",
+						},
+						MaintenanceWindow: sqlv1alpha1.PostgresInstanceSettingsMaintenanceWindow{
+							Day:  7,
+							Hour: 4,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+var _ = Describe("PostgreSql controller", func() {
+	var (
+		ctx        context.Context
+		namespace  string
+		instance   *sqlv1alpha1.PostgreSql
+		executor   *terraform.FakeExecutor
+		reconciler *PostgreSqlReconciler
+		workspaces *workspace.Manager
+		req        ctrl.Request
+	)
+
+	phaseOf := func() sqlv1alpha1.ObjectPhase {
+		current := &sqlv1alpha1.PostgreSql{}
+		Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+		return current.Status.Phase
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = "terrak8s-" + rand.String(6)
+		Expect(k8sClient.Create(ctx, &kubeApiV1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: namespace},
+		})).To(Succeed())
+		Expect(k8sClient.Create(ctx, &kubeApiV1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "mypassword", Namespace: namespace},
+			Data:       map[string][]byte{"mykey": []byte("jEnv2000!")},
+		})).To(Succeed())
+		Expect(k8sClient.Create(ctx, &kubeApiV1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "gcp-sa", Namespace: namespace},
+			Data:       map[string][]byte{"sa.json": []byte(`{"type": "service_account"}`)},
+		})).To(Succeed())
+
+		instance = newTestPostgreSql(namespace)
+		Expect(k8sClient.Create(ctx, instance)).To(Succeed())
+		req = ctrl.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: instance.Name}}
+
+		root, err := ioutil.TempDir("", "workspaces")
+		Expect(err).ToNot(HaveOccurred())
+		workspaces = workspace.NewManager(root)
+		executor = terraform.NewFakeExecutor().
+			On("show", terraform.FakeResponse{Stdout: testPlan}).
+			On("output", terraform.FakeResponse{Stdout: testOutput})
+		reconciler = &PostgreSqlReconciler{
+			Client:     k8sClient,
+			Log:        logf.Log.WithName("controllers").WithName("PostgreSql"),
+			Scheme:     scheme.Scheme,
+			Recorder:   record.NewFakeRecorder(1024),
+			Executor:   executor,
+			Workspaces: workspaces,
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workspaces.Root)).To(Succeed())
+	})
+
+	It("Should go through Initializing and Applying before Running", func() {
+		phases := make(map[string]sqlv1alpha1.ObjectPhase)
+		executor.OnRun = func(inv terraform.Invocation) {
+			phases[filepath.Base(inv.Dir)+"/"+inv.Args[0]] = phaseOf()
+		}
+
+		result, err := reconciler.Reconcile(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		Expect(executor.Commands()).To(Equal([]string{
+			"bucket/init", "bucket/state", "bucket/import", "bucket/apply",
+			"instance/init", "instance/plan", "instance/show", "instance/apply", "instance/output",
+		}))
+		Expect(phases["bucket/init"]).To(Equal(sqlv1alpha1.PhaseInitializing))
+		Expect(phases["instance/init"]).To(Equal(sqlv1alpha1.PhaseInitializing))
+		Expect(phases["instance/plan"]).To(Equal(sqlv1alpha1.PhaseApplying))
+		Expect(phases["instance/apply"]).To(Equal(sqlv1alpha1.PhaseApplying))
+
+		current := &sqlv1alpha1.PostgreSql{}
+		Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+		Expect(current.Status.Phase).To(Equal(sqlv1alpha1.PhaseRunning))
+		Expect(current.Status.Output.ConnectionIPAddress).To(Equal("10.0.0.3"))
+		Expect(current.Status.Output.ConnectionName).To(Equal("my-project:region-1:my-instance"))
+		Expect(current.GetFinalizers()).To(ContainElement(Finalizer))
+	})
+
+	It("Should pass the GCP credentials to every terraform run", func() {
+		_, err := reconciler.Reconcile(req)
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, inv := range executor.Invocations() {
+			Expect(inv.Env).To(ContainElement(`GOOGLE_CREDENTIALS={"type": "service_account"}`))
+		}
+		Expect(os.Getenv("GOOGLE_CREDENTIALS")).To(BeEmpty())
+		Expect(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")).To(BeEmpty())
+	})
+
+	It("Should not leave any credentials in the workspace", func() {
+		dir, err := workspaces.Create(req.NamespacedName)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "sa.json"), []byte(`{"type": "service_account"}`), 0600)).To(Succeed())
+
+		_, err = reconciler.Reconcile(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Join(dir, "sa.json")).ShouldNot(BeAnExistingFile())
+		Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+	})
+
+	It("Should report the deprecated credentials once", func() {
+		recorder := reconciler.Recorder.(*record.FakeRecorder)
+		for i := 0; i < 2; i++ {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.SetAnnotations(map[string]string{sqlv1alpha1.ReconcileAnnotation: fmt.Sprint(i)})
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		current := &sqlv1alpha1.PostgreSql{}
+		Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+		condition := util.GetCondition(current.Status.Conditions, sqlv1alpha1.ConditionDeprecatedCredentials)
+		Expect(condition).ToNot(BeNil())
+		Expect(condition.Status).To(Equal(kubeApiV1.ConditionTrue))
+		close(recorder.Events)
+		deprecated := 0
+		for event := range recorder.Events {
+			if strings.Contains(event, "DeprecatedCredentials") {
+				deprecated++
+			}
+		}
+		Expect(deprecated).To(Equal(1))
+	})
+
+	It("Should pass the passwords to terraform through sensitive variables only", func() {
+		executor.On("apply", terraform.FakeResponse{Stderr: "Error: invalid password jEnv2000! for user-1", ExitCode: 1})
+		recorder := reconciler.Recorder.(*record.FakeRecorder)
+
+		_, err := reconciler.Reconcile(req)
+		Expect(err).ToNot(HaveOccurred())
+		for _, inv := range executor.Invocations() {
+			if filepath.Base(inv.Dir) == "instance" {
+				Expect(inv.Env).To(ContainElement("TF_VAR_user_0_password=jEnv2000!"))
+			}
+		}
+		err = filepath.Walk(workspaces.Path(req.NamespacedName), func(path string, info os.FileInfo, err error) error {
+			Expect(err).ToNot(HaveOccurred())
+			if !info.IsDir() {
+				b, errR := ioutil.ReadFile(path)
+				Expect(errR).ToNot(HaveOccurred())
+				Expect(string(b)).ToNot(ContainSubstring("jEnv2000!"), path)
+			}
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		current := &sqlv1alpha1.PostgreSql{}
+		Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+		Expect(current.Status.Phase).To(Equal(sqlv1alpha1.PhaseFailed))
+		Expect(fmt.Sprint(current.Status)).ToNot(ContainSubstring("jEnv2000!"))
+		Expect(fmt.Sprint(current.Status)).To(ContainSubstring(terraform.Redacted))
+		close(recorder.Events)
+		for event := range recorder.Events {
+			Expect(event).ToNot(ContainSubstring("jEnv2000!"))
+		}
+	})
+
+	Context("With credentials.secretKeyRef", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, &kubeApiV1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "terraform-sa", Namespace: namespace},
+				Data:       map[string][]byte{"key": []byte(`{"type": "service_account", "client_email": "terraform"}`)},
+			})).To(Succeed())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.Project.Credentials = &sqlv1alpha1.PostgresqlInstanceCredentials{
+				SecretKeyRef: sqlv1alpha1.PostgresInstanceDatabasePasswordSpec{Name: "terraform-sa", Key: "key"},
+			}
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+		})
+
+		It("Should only read the referenced key", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, inv := range executor.Invocations() {
+				Expect(inv.Env).To(ContainElement(`GOOGLE_CREDENTIALS={"type": "service_account", "client_email": "terraform"}`))
+			}
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+
+		It("Should not run terraform without the referenced key", func() {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.Project.Credentials.SecretKeyRef.Key = "missing"
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(BeEmpty())
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseFailed))
+		})
+	})
+
+	Context("With Workload Identity", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Delete(ctx, &kubeApiV1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "gcp-sa", Namespace: namespace}})).To(Succeed())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.Project.AuthMode = sqlv1alpha1.AuthWorkloadIdentity
+			current.Spec.Project.ImpersonateServiceAccount = "demo@my-project.iam.gserviceaccount.com"
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+		})
+
+		It("Should run terraform with the ambient credentials and impersonate the service account", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			for _, inv := range executor.Invocations() {
+				for _, kv := range inv.Env {
+					Expect(kv).ToNot(HavePrefix("GOOGLE_"))
+				}
+			}
+			b, err := ioutil.ReadFile(filepath.Join(workspaces.Path(req.NamespacedName), "instance", "provider.tf.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(b)).To(ContainSubstring(`"impersonate_service_account": "demo@my-project.iam.gserviceaccount.com"`))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+	})
+
+	It("Should record the plan summary and apply the saved plan", func() {
+		_, err := reconciler.Reconcile(req)
+		Expect(err).ToNot(HaveOccurred())
+
+		current := &sqlv1alpha1.PostgreSql{}
+		Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+		Expect(current.Status.Plan).ToNot(BeNil())
+		Expect(current.Status.Plan.Add).To(Equal(2))
+		Expect(current.Status.Plan.Change).To(BeZero())
+		Expect(current.Status.Plan.Destroy).To(BeZero())
+		Expect(current.Status.Plan.Resources).To(Equal([]string{"google_sql_database_instance.instance", "google_sql_database.database"}))
+		Expect(current.Status.Plan.Hash).ToNot(BeEmpty())
+		apply := executor.Invocations()[7]
+		Expect(apply.Args).To(Equal([]string{"apply", "-input=false", terraform.PlanFile}))
+	})
+
+	It("Should not apply an empty plan", func() {
+		executor.On("show", terraform.FakeResponse{Stdout: `{"format_version": "0.1"}`})
+
+		_, err := reconciler.Reconcile(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(executor.Commands()).ToNot(ContainElement("instance/apply"))
+		Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+	})
+
+	Context("With manual approval", func() {
+		var hash string
+
+		BeforeEach(func() {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.ApprovalMode = sqlv1alpha1.ApprovalManual
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+
+			plan, err := terraform.ParsePlan([]byte(testReplacePlan))
+			Expect(err).ToNot(HaveOccurred())
+			hash = plan.Hash
+		})
+
+		approve := func(value string) {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.SetAnnotations(map[string]string{sqlv1alpha1.ApprovePlanAnnotation: value})
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+		}
+
+		It("Should apply plans which do not destroy resources", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(ContainElement("instance/apply"))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+
+		It("Should wait for the approval of plans replacing resources", func() {
+			executor.On("show", terraform.FakeResponse{Stdout: testReplacePlan})
+			executor.OnRun = func(inv terraform.Invocation) {
+				if inv.Args[0] == "plan" {
+					// Save the plan, as terraform plan -out does
+					Expect(ioutil.WriteFile(filepath.Join(inv.Dir, terraform.PlanFile), []byte("plan"), 0600)).To(Succeed())
+				}
+			}
+
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(ctrl.Result{}))
+			Expect(executor.Commands()).ToNot(ContainElement("instance/apply"))
+
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.Status.Phase).To(Equal(sqlv1alpha1.PhaseAwaitingApproval))
+			Expect(current.Status.Plan.Hash).To(Equal(hash))
+			Expect(filepath.Join(workspaces.Path(req.NamespacedName), "instance", terraform.PlanFile)).ToNot(BeAnExistingFile())
+
+			By("rejecting a stale approval")
+			approve("0123456789abcdef")
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).ToNot(ContainElement("instance/apply"))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseAwaitingApproval))
+
+			By("applying the approved plan")
+			approve(hash)
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(ContainElement("instance/apply"))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+
+			By("consuming the approval")
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.GetAnnotations()).ToNot(HaveKey(sqlv1alpha1.ApprovePlanAnnotation))
+			current.SetAnnotations(map[string]string{sqlv1alpha1.ReconcileAnnotation: "1"})
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			executor.Reset()
+			executor.On("show", terraform.FakeResponse{Stdout: testReplacePlan})
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).ToNot(ContainElement("instance/apply"))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseAwaitingApproval))
+		})
+	})
+
+	Context("With adoption", func() {
+		var hash string
+
+		BeforeEach(func() {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.Adopt = true
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+
+			executor.On("instance/state", terraform.FakeResponse{Stdout: "google_sql_user.default\n"})
+			plan, err := terraform.ParsePlan([]byte(testPlan))
+			Expect(err).ToNot(HaveOccurred())
+			hash = plan.Hash
+		})
+
+		It("Should import the resources missing from the state before the first plan", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			var imported []string
+			for _, inv := range executor.Invocations() {
+				if filepath.Base(inv.Dir) == "instance" && inv.Args[0] == "import" {
+					imported = append(imported, inv.Args[2]+"="+inv.Args[3])
+				}
+			}
+			Expect(imported).To(Equal([]string{
+				"google_sql_database_instance.instance=my-project/my-instance",
+				"google_sql_database.database=my-project/my-instance/db",
+			}))
+			Expect(executor.Commands()).To(ContainElement("instance/plan"))
+			for _, command := range executor.Commands() {
+				Expect(command).ToNot(Equal("instance/plan"), "the plan ran before the imports")
+				if command == "instance/import" {
+					break
+				}
+			}
+		})
+
+		It("Should wait for the approval of the plan following the import", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).ToNot(ContainElement("instance/apply"))
+
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.Status.Phase).To(Equal(sqlv1alpha1.PhaseAwaitingApproval))
+			Expect(current.Status.Plan.Hash).To(Equal(hash))
+
+			current.SetAnnotations(map[string]string{sqlv1alpha1.ApprovePlanAnnotation: hash})
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(ContainElement("instance/apply"))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+
+		It("Should let the plan create the resources which do not exist", func() {
+			executor.On("instance/import", terraform.FakeResponse{ExitCode: 1, Stderr: "Error: Cannot import non-existent remote object"})
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(ContainElement("instance/plan"))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseAwaitingApproval))
+		})
+
+		It("Should mark the instance as Failed when the import fails", func() {
+			executor.On("instance/import", terraform.FakeResponse{ExitCode: 1, Stderr: "Error: googleapi: Error 403"})
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).ToNot(ContainElement("instance/plan"))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseFailed))
+		})
+	})
+
+	Context("With saved stages", func() {
+		stageOf := func(name sqlv1alpha1.StageName) sqlv1alpha1.PostgreSqlStage {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			for _, stage := range current.Status.Stages {
+				if stage.Name == name {
+					return stage
+				}
+			}
+			return sqlv1alpha1.PostgreSqlStage{}
+		}
+
+		It("Should not run terraform for an unchanged instance", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			for _, name := range Stages {
+				Expect(stageOf(name).Status).To(Equal(sqlv1alpha1.StageCompleted))
+			}
+			executor.Reset()
+
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(ctrl.Result{}))
+			Expect(executor.Commands()).To(BeEmpty())
+
+			By("waiting for the next drift check")
+			reconciler.DriftCheckInterval = time.Hour
+			result, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically("~", time.Hour, time.Minute))
+			Expect(executor.Commands()).To(BeEmpty())
+		})
+
+		It("Should resume from the failed stage", func() {
+			executor.On("output", terraform.FakeResponse{ExitCode: 1, Stderr: "Error: googleapi: Error 503: backendError"}, terraform.FakeResponse{Stdout: testOutput})
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseFailed))
+			Expect(stageOf(sqlv1alpha1.StageInstance).Status).To(Equal(sqlv1alpha1.StageCompleted))
+			Expect(stageOf(sqlv1alpha1.StageOutput).Status).To(Equal(sqlv1alpha1.StageFailed))
+			executor.Reset()
+			executor.On("output", terraform.FakeResponse{Stdout: testOutput})
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{"instance/output"}))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+
+		It("Should only run the stages whose inputs changed", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			executor.Reset()
+			executor.On("show", terraform.FakeResponse{Stdout: testDriftPlan}).
+				On("output", terraform.FakeResponse{Stdout: testOutput})
+
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.SqlInstance.Settings[0].MachineType = "db-custom-1-3840"
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{"instance/plan", "instance/show", "instance/apply", "instance/output"}))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+
+		It("Should not run terraform in a new workspace until a reconcile is requested", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.Status.LastAppliedHash).ToNot(BeEmpty())
+			executor.Reset()
+			executor.On("show", terraform.FakeResponse{Stdout: `{"format_version": "0.1"}`}).
+				On("output", terraform.FakeResponse{Stdout: testOutput})
+			Expect(workspaces.Remove(req.NamespacedName)).To(Succeed())
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(BeEmpty())
+
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.SetAnnotations(map[string]string{sqlv1alpha1.ReconcileAnnotation: "2021-03-02T13:19:13Z"})
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{
+				"bucket/init", "bucket/state", "bucket/import", "bucket/apply", "instance/init", "instance/plan", "instance/show", "instance/output",
+			}))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+
+			By("handling the request once")
+			executor.Reset()
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(BeEmpty())
+		})
+
+		It("Should apply again when a referenced secret changes", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			executor.Reset()
+			executor.On("show", terraform.FakeResponse{Stdout: testDriftPlan}).
+				On("output", terraform.FakeResponse{Stdout: testOutput})
+
+			password := &kubeApiV1.Secret{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "mypassword"}, password)).To(Succeed())
+			password.Data["mykey"] = []byte("jEnv2021!")
+			Expect(k8sClient.Update(ctx, password)).To(Succeed())
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{"instance/plan", "instance/show", "instance/apply", "instance/output"}))
+		})
+	})
+
+	Context("With drift detection", func() {
+		BeforeEach(func() {
+			reconciler.DriftCheckInterval = time.Hour
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(time.Hour))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+			executor.Reset()
+			executor.On("output", terraform.FakeResponse{Stdout: testOutput})
+
+			By("waiting for the next drift check")
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			for i := range current.Status.Stages {
+				current.Status.Stages[i].LastRunTime = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+			}
+			Expect(k8sClient.Status().Update(ctx, current)).To(Succeed())
+		})
+
+		driftedOf := func() *sqlv1alpha1.PostgreSqlCondition {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			for i := range current.Status.Conditions {
+				if current.Status.Conditions[i].Type == sqlv1alpha1.ConditionDrifted {
+					return &current.Status.Conditions[i]
+				}
+			}
+			return nil
+		}
+
+		setPolicy := func(policy sqlv1alpha1.DriftPolicy) {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.DriftPolicy = policy
+			current.Spec.DriftCheckInterval = &metav1.Duration{Duration: 10 * time.Minute}
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			current.Status.ObservedGeneration = current.Generation
+			Expect(k8sClient.Status().Update(ctx, current)).To(Succeed())
+		}
+
+		It("Should only check an unchanged instance for drifts", func() {
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(time.Hour))
+			Expect(executor.Commands()).To(Equal([]string{"instance/plan"}))
+			Expect(executor.Invocations()[0].Args).To(ContainElement("-detailed-exitcode"))
+			Expect(driftedOf().Status).To(Equal(kubeApiV1.ConditionFalse))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+
+		It("Should report drifts without applying under the Report policy", func() {
+			setPolicy(sqlv1alpha1.DriftReport)
+			executor.On("instance/plan", terraform.FakeResponse{ExitCode: 2, Stdout: testDriftLog})
+
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(10 * time.Minute))
+			Expect(executor.Commands()).To(Equal([]string{"instance/plan"}))
+			drifted := driftedOf()
+			Expect(drifted.Status).To(Equal(kubeApiV1.ConditionTrue))
+			Expect(drifted.Reason).To(Equal("DriftDetected"))
+			Expect(drifted.Message).To(ContainSubstring("google_sql_database_instance.instance"))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+
+		It("Should apply the spec again under the Correct policy", func() {
+			setPolicy(sqlv1alpha1.DriftCorrect)
+			executor.On("instance/plan", terraform.FakeResponse{ExitCode: 2, Stdout: testDriftLog}, terraform.FakeResponse{}).
+				On("show", terraform.FakeResponse{Stdout: testDriftPlan})
+
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(10 * time.Minute))
+			Expect(executor.Commands()).To(ContainElement("instance/apply"))
+			drifted := driftedOf()
+			Expect(drifted.Status).To(Equal(kubeApiV1.ConditionFalse))
+			Expect(drifted.Reason).To(Equal("DriftCorrected"))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+	})
+
+	Context("With a locked state", func() {
+		const lockStderr = `Error: Error locking state: Error acquiring the state lock: googleapi: Error 412: Precondition Failed
+Lock Info:
+  ID:        1614691153284474
+  Path:      gs://my-bucket/test/tfstate/default.tflock
+  Operation: OperationTypeApply
+  Who:       nonroot@terrak8s-controller-0
+  Version:   0.13.5
+  Created:   2021-03-02 13:19:13.140146 +0000 UTC
+  Info:
+`
+		stateLockedOf := func() *sqlv1alpha1.PostgreSqlCondition {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			for i := range current.Status.Conditions {
+				if current.Status.Conditions[i].Type == sqlv1alpha1.ConditionStateLocked {
+					return &current.Status.Conditions[i]
+				}
+			}
+			return nil
+		}
+
+		BeforeEach(func() {
+			executor.On("instance/plan", terraform.FakeResponse{ExitCode: 1, Stderr: lockStderr}, terraform.FakeResponse{})
+		})
+
+		It("Should report the lock holder without failing the instance", func() {
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(5 * time.Second))
+			Expect(phaseOf()).ToNot(Equal(sqlv1alpha1.PhaseFailed))
+			locked := stateLockedOf()
+			Expect(locked.Status).To(Equal(kubeApiV1.ConditionTrue))
+			Expect(locked.Message).To(ContainSubstring("nonroot@terrak8s-controller-0"))
+			Expect(locked.Message).To(ContainSubstring("1614691153284474"))
+			Expect(executor.Commands()).ToNot(ContainElement("instance/force-unlock"))
+
+			By("clearing the condition once the lock is released")
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stateLockedOf().Status).To(Equal(kubeApiV1.ConditionFalse))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+
+		It("Should only force-unlock the confirmed lock", func() {
+			forceUnlock := func(id string) {
+				current := &sqlv1alpha1.PostgreSql{}
+				Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+				current.SetAnnotations(map[string]string{sqlv1alpha1.ForceUnlockAnnotation: id})
+				Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			}
+			executor.On("instance/plan", terraform.FakeResponse{ExitCode: 1, Stderr: lockStderr})
+
+			forceUnlock("1234")
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).ToNot(ContainElement("instance/force-unlock"))
+
+			forceUnlock("1614691153284474")
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(ContainElement("instance/force-unlock"))
+			Expect(stateLockedOf().Reason).To(Equal("ForceUnlocked"))
+		})
+	})
+
+	It("Should mark the instance as Failed when terraform apply fails", func() {
+		executor.On("instance/apply", terraform.FakeResponse{ExitCode: 1, Stderr: "Error: googleapi: Error 503: backendError"})
+
+		result, err := reconciler.Reconcile(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.RequeueAfter).To(Equal(5 * time.Second))
+		Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseFailed))
+		Expect(executor.Commands()).ToNot(ContainElement("instance/output"))
+	})
+
+	Context("With failing terraform runs", func() {
+		failedOf := func() (*sqlv1alpha1.PostgreSqlCondition, int32) {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			for i := range current.Status.Conditions {
+				if current.Status.Conditions[i].Type == sqlv1alpha1.ConditionFailed {
+					return &current.Status.Conditions[i], current.Status.Retries
+				}
+			}
+			return nil, current.Status.Retries
+		}
+
+		It("Should not retry invalid configurations", func() {
+			executor.On("instance/apply", terraform.FakeResponse{ExitCode: 1, Stderr: "\nError: Error, failed to create instance my-instance: googleapi: Error 400: Invalid request: Invalid Tier (db-f1-mikro) for (POSTGRES_9_6) Project., invalid\n\n  on instance.tf.json line 1\n"})
+
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(ctrl.Result{}))
+			failed, _ := failedOf()
+			Expect(failed.Status).To(Equal(kubeApiV1.ConditionTrue))
+			Expect(failed.Reason).To(Equal("InvalidConfiguration"))
+			Expect(failed.Message).To(Equal("Error, failed to create instance my-instance: googleapi: Error 400: Invalid request: Invalid Tier (db-f1-mikro) for (POSTGRES_9_6) Project., invalid"))
+		})
+
+		It("Should back off on quota errors until a run succeeds", func() {
+			quota := terraform.FakeResponse{ExitCode: 1, Stderr: "Error: googleapi: Error 429: Quota exceeded for quota metric 'Queries', rateLimitExceeded"}
+			executor.On("bucket/apply", quota, quota, terraform.FakeResponse{})
+
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(time.Minute))
+			failed, retries := failedOf()
+			Expect(failed.Reason).To(Equal("QuotaExceeded"))
+			Expect(retries).To(Equal(int32(1)))
+
+			result, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(2 * time.Minute))
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+			failed, retries = failedOf()
+			Expect(failed.Status).To(Equal(kubeApiV1.ConditionFalse))
+			Expect(retries).To(BeZero())
+		})
+
+		It("Should retry authentication errors slowly", func() {
+			executor.On("instance/init", terraform.FakeResponse{ExitCode: 1, Stderr: "Error: googleapi: Error 403: The caller does not have permission, forbidden"})
+
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(5 * time.Minute))
+			failed, _ := failedOf()
+			Expect(failed.Reason).To(Equal("AuthenticationFailed"))
+		})
+	})
+
+	It("Should cap the retry backoff", func() {
+		policy := RetryPolicy{Base: time.Second, Max: 10 * time.Second}
+		Expect(policy.Delay(1)).To(Equal(time.Second))
+		Expect(policy.Delay(3)).To(Equal(4 * time.Second))
+		Expect(policy.Delay(10)).To(Equal(10 * time.Second))
+		Expect(RetryPolicies[terraform.ErrorPermanent].Delay(3)).To(BeZero())
+	})
+
+	It("Should destroy the terraform resources once the instance is deleted", func() {
+		_, err := reconciler.Reconcile(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+
+		current := &sqlv1alpha1.PostgreSql{}
+		Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+		destroy := true
+		current.Spec.BucketConfig.Destroy = &destroy
+		// The PostgreSqls of the other tests still use my-bucket
+		current.Spec.RemoteState.BucketName = namespace
+		Expect(k8sClient.Update(ctx, current)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, current)).To(Succeed())
+		executor.Reset()
+
+		_, err = reconciler.Reconcile(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(executor.Commands()).To(Equal([]string{"instance/destroy", "bucket/destroy"}))
+		Expect(workspaces.Path(req.NamespacedName)).ShouldNot(BeADirectory())
+		Eventually(func() bool {
+			return errors.IsNotFound(k8sClient.Get(ctx, req.NamespacedName, &sqlv1alpha1.PostgreSql{}))
+		}).Should(BeTrue())
+	})
+
+	Context("With a deletion policy", func() {
+		deleteWith := func(policy sqlv1alpha1.DeletionPolicy) {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.DeletionPolicy = policy
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, current)).To(Succeed())
+			executor.Reset()
+		}
+
+		It("Should leave the cloud resources behind under the Retain policy", func() {
+			reconciler.StateExportNamespace = "default"
+			deleteWith(sqlv1alpha1.DeletionRetain)
+			executor.On("bucket/state", terraform.FakeResponse{Stdout: `{"version": 4, "serial": 1}`})
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{"bucket/state"}))
+
+			By("exporting the local state of the bucket")
+			exported := &kubeApiV1.Secret{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: StateExportName(instance)}, exported)).To(Succeed())
+			Expect(exported.Data).ToNot(HaveKey("instance.tfstate"))
+			Expect(string(exported.Data["bucket.tfstate"])).To(Equal(`{"version": 4, "serial": 1}`))
+			Expect(workspaces.Path(req.NamespacedName)).ShouldNot(BeADirectory())
+			Eventually(func() bool {
+				return errors.IsNotFound(k8sClient.Get(ctx, req.NamespacedName, &sqlv1alpha1.PostgreSql{}))
+			}).Should(BeTrue())
+		})
+
+		It("Should export the states under the Orphan policy", func() {
+			reconciler.StateExportNamespace = "default"
+			deleteWith(sqlv1alpha1.DeletionOrphan)
+			executor.On("instance/state", terraform.FakeResponse{Stdout: `{"version": 4, "serial": 3}`}).
+				On("bucket/state", terraform.FakeResponse{Stdout: `{"version": 4, "serial": 1}`})
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{"instance/state", "bucket/state"}))
+			Expect(executor.Invocations()[0].Args).To(Equal([]string{"state", "pull"}))
+
+			exported := &kubeApiV1.Secret{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: StateExportName(instance)}, exported)).To(Succeed())
+			Expect(exported.Annotations).To(HaveKeyWithValue(StateExportAnnotation, namespace+"/my-instance"))
+			Expect(string(exported.Data["instance.tfstate"])).To(Equal(`{"version": 4, "serial": 3}`))
+			Expect(string(exported.Data["bucket.tfstate"])).To(Equal(`{"version": 4, "serial": 1}`))
+			Eventually(func() bool {
+				return errors.IsNotFound(k8sClient.Get(ctx, req.NamespacedName, &sqlv1alpha1.PostgreSql{}))
+			}).Should(BeTrue())
+		})
+
+		It("Should name the exported states after the namespace and the name of the instance", func() {
+			first := &sqlv1alpha1.PostgreSql{ObjectMeta: metav1.ObjectMeta{Namespace: "a-b", Name: "c"}}
+			second := &sqlv1alpha1.PostgreSql{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "b-c"}}
+			Expect(StateExportName(first)).To(HavePrefix("tfstate-a-b-c-"))
+			Expect(StateExportName(first)).ToNot(Equal(StateExportName(second)))
+		})
+
+		It("Should disable the deletion protection before destroying", func() {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.SqlInstance.DeletionProtection = true
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			deleteWith(sqlv1alpha1.DeletionDelete)
+			Expect(ioutil.ReadFile(filepath.Join(workspaces.Path(req.NamespacedName), "instance", "main.tf.json"))).To(ContainSubstring(`"deletion_protection": true`))
+			var protection []string
+			executor.OnRun = func(inv terraform.Invocation) {
+				b, err := ioutil.ReadFile(filepath.Join(inv.Dir, "main.tf.json"))
+				if err == nil {
+					protection = append(protection, inv.Args[0]+fmt.Sprintf(":%v", strings.Contains(string(b), `"deletion_protection": true`)))
+				}
+			}
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{"instance/apply", "instance/destroy"}))
+			Expect(protection).To(Equal([]string{"apply:false", "destroy:false"}))
+		})
+
+		It("Should keep the finalizer until the states are exported", func() {
+			deleteWith(sqlv1alpha1.DeletionOrphan)
+			executor.On("bucket/state", terraform.FakeResponse{ExitCode: 1, Stderr: "Error: Failed to load state"})
+
+			result, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(5 * time.Second))
+			Expect(k8sClient.Get(ctx, req.NamespacedName, &sqlv1alpha1.PostgreSql{})).To(Succeed())
+			Expect(executor.Commands()).ToNot(ContainElement("instance/destroy"))
+		})
+	})
+
+	Context("With a shared state bucket", func() {
+		It("Should import the bucket unless it is already in the state", func() {
+			executor.On("bucket/state", terraform.FakeResponse{Stdout: "google_storage_bucket.bucket\n"})
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).ToNot(ContainElement("bucket/import"))
+		})
+
+		It("Should import the bucket of another PostgreSql", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			for _, inv := range executor.Invocations() {
+				if filepath.Base(inv.Dir) == "bucket" && inv.Args[0] == "import" {
+					Expect(inv.Args).To(Equal([]string{"import", "-input=false", "google_storage_bucket.bucket", "my-project/my-bucket"}))
+				}
+			}
+		})
+
+		It("Should not destroy the bucket while another PostgreSql uses it", func() {
+			other := newTestPostgreSql(namespace)
+			other.Name = "my-other-instance"
+			Expect(k8sClient.Create(ctx, other)).To(Succeed())
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			destroy := true
+			current.Spec.BucketConfig.Destroy = &destroy
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, current)).To(Succeed())
+			executor.Reset()
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{"instance/destroy"}))
+			Eventually(func() bool {
+				return errors.IsNotFound(k8sClient.Get(ctx, req.NamespacedName, &sqlv1alpha1.PostgreSql{}))
+			}).Should(BeTrue())
+		})
+	})
+
+	Context("With the kubernetes backend", func() {
+		BeforeEach(func() {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.RemoteState = sqlv1alpha1.PostgresqlInstanceBackend{Type: sqlv1alpha1.BackendKubernetes}
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+		})
+
+		It("Should store the state in the namespace without any bucket", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{
+				"instance/init", "instance/plan", "instance/show", "instance/apply", "instance/output",
+			}))
+			Expect(filepath.Join(workspaces.Path(req.NamespacedName), "bucket", "bucket.tf.json")).ShouldNot(BeAnExistingFile())
+			b, err := ioutil.ReadFile(filepath.Join(workspaces.Path(req.NamespacedName), "instance", "backend.tf.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(b)).To(ContainSubstring(`"namespace": "` + namespace + `"`))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+
+		It("Should delete the state secrets once the instance is destroyed", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			state := &kubeApiV1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "tfstate-default-postgresql-my-instance",
+					Namespace: namespace,
+					Labels:    map[string]string{terraform.StateLabel: "my-instance"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, state)).To(Succeed())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, current)).To(Succeed())
+			executor.Reset()
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{"instance/destroy"}))
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: state.Name}, &kubeApiV1.Secret{}))).To(BeTrue())
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "gcp-sa"}, &kubeApiV1.Secret{})).To(Succeed())
+		})
+	})
+
+	Context("With the http backend", func() {
+		BeforeEach(func() {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.RemoteState = sqlv1alpha1.PostgresqlInstanceBackend{Type: sqlv1alpha1.BackendHTTP}
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			reconciler.StateBackendAddress = "http://127.0.0.1:8082"
+			executor.OnRun = func(inv terraform.Invocation) {
+				if filepath.Base(inv.Dir) != "instance" || inv.Args[0] != "apply" {
+					return
+				}
+				// terraform posts the applied state to the http backend
+				state := &kubeApiV1.Secret{}
+				Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: statebackend.SecretName(instance.Name)}, state)).To(Succeed())
+				state.Data[statebackend.StateKey] = []byte(`{"version": 4, "lineage": "3b7e0f4c", "serial": 7, "outputs": ` + testOutput + `}`)
+				Expect(k8sClient.Update(ctx, state)).To(Succeed())
+			}
+		})
+
+		It("Should read the outputs from the state served by the manager", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{
+				"instance/init", "instance/plan", "instance/show", "instance/apply",
+			}))
+			b, err := ioutil.ReadFile(filepath.Join(workspaces.Path(req.NamespacedName), "instance", "backend.tf.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(b)).To(ContainSubstring(`"address": "http://127.0.0.1:8082/state/` + namespace + `/my-instance"`))
+
+			By("passing the password of the backend through the environment only")
+			state := &kubeApiV1.Secret{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: statebackend.SecretName(instance.Name)}, state)).To(Succeed())
+			token := string(state.Data[statebackend.TokenKey])
+			Expect(string(b)).ToNot(ContainSubstring(token))
+			Expect(executor.Invocations()[0].Env).To(ContainElement("TF_HTTP_PASSWORD=" + token))
+
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.Status.Phase).To(Equal(sqlv1alpha1.PhaseRunning))
+			Expect(current.Status.Output.ConnectionName).To(Equal("my-project:region-1:my-instance"))
+			Expect(current.Status.StateSerial).To(Equal(int64(7)))
+		})
+
+		It("Should fail when the http backend is not served", func() {
+			reconciler.StateBackendAddress = ""
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(BeEmpty())
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseFailed))
+		})
+
+		It("Should keep the state of a retained instance", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.DeletionPolicy = sqlv1alpha1.DeletionRetain
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, current)).To(Succeed())
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			state := &kubeApiV1.Secret{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: statebackend.SecretName(instance.Name)}, state)).To(Succeed())
+			Expect(state.OwnerReferences).To(BeEmpty())
+		})
+
+		It("Should not run terraform against a state secret it does not own", func() {
+			Expect(k8sClient.Create(ctx, &kubeApiV1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: statebackend.SecretName(instance.Name), Namespace: namespace},
+				Data:       map[string][]byte{statebackend.TokenKey: []byte("retained")},
+			})).To(Succeed())
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(BeEmpty())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			c := util.GetCondition(current.Status.Conditions, sqlv1alpha1.ConditionStateSecretConflict)
+			Expect(c).ToNot(BeNil())
+			Expect(c.Status).To(Equal(kubeApiV1.ConditionTrue))
+		})
+	})
+
+	Context("With the s3 backend", func() {
+		BeforeEach(func() {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.RemoteState = sqlv1alpha1.PostgresqlInstanceBackend{
+				Type: sqlv1alpha1.BackendS3,
+				S3: &sqlv1alpha1.PostgresqlInstanceS3Backend{
+					Endpoint:       "http://127.0.0.1:9000",
+					Bucket:         "tfstate",
+					ForcePathStyle: true,
+					CredentialsSecretRef: sqlv1alpha1.PostgresqlInstanceS3Credentials{
+						Name: "minio-keys",
+					},
+				},
+			}
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+		})
+
+		It("Should pass the access keys of the store to every terraform run", func() {
+			Expect(k8sClient.Create(ctx, &kubeApiV1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "minio-keys", Namespace: namespace},
+				Data: map[string][]byte{
+					"AWS_ACCESS_KEY_ID":     []byte("minioadmin"),
+					"AWS_SECRET_ACCESS_KEY": []byte("minio-secret"),
+				},
+			})).To(Succeed())
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{
+				"instance/init", "instance/plan", "instance/show", "instance/apply", "instance/output",
+			}))
+			for _, inv := range executor.Invocations() {
+				Expect(inv.Env).To(ContainElement("AWS_ACCESS_KEY_ID=minioadmin"))
+				Expect(inv.Env).To(ContainElement("AWS_SECRET_ACCESS_KEY=minio-secret"))
+			}
+			b, err := ioutil.ReadFile(filepath.Join(workspaces.Path(req.NamespacedName), "instance", "backend.tf.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(b)).ToNot(ContainSubstring("minio-secret"))
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+		})
+
+		It("Should not run terraform without the access keys", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(BeEmpty())
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseFailed))
+		})
+	})
+
+	Context("With a new remoteState", func() {
+		const (
+			testInitialized   = `{"version": 3, "backend": {"type": "gcs", "config": {"bucket": "my-bucket", "prefix": "test/tfstate", "credentials": null}}}`
+			testPreviousState = `{"version": 4, "lineage": "3b7e0f4c", "serial": 7, "resources": [{"mode": "managed", "instances": [{}]}, {"mode": "managed", "instances": [{}]}]}`
+		)
+
+		BeforeEach(func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			// terraform init records the backend of the workspace
+			Expect(ioutil.WriteFile(filepath.Join(workspaces.Path(req.NamespacedName), "instance", ".terraform", "terraform.tfstate"), []byte(testInitialized), 0600)).To(Succeed())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.Status.StateLocation).To(Equal("gs://my-bucket/test/tfstate"))
+			current.Spec.RemoteState = sqlv1alpha1.PostgresqlInstanceBackend{Type: sqlv1alpha1.BackendKubernetes}
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			executor.Reset()
+			executor.On("show", terraform.FakeResponse{Stdout: `{"format_version": "0.1"}`}).
+				On("output", terraform.FakeResponse{Stdout: testOutput})
+		})
+
+		It("Should wait for the migrate-state annotation before migrating the state", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(BeEmpty())
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseAwaitingApproval))
+
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.SetAnnotations(map[string]string{sqlv1alpha1.MigrateStateAnnotation: "kubernetes"})
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			executor.On("migration/state", terraform.FakeResponse{Stdout: testPreviousState})
+			executor.OnRun = func(inv terraform.Invocation) {
+				if filepath.Base(inv.Dir) != "migration" || inv.Args[0] != "init" {
+					return
+				}
+				b, err := ioutil.ReadFile(filepath.Join(inv.Dir, "backend.tf.json"))
+				Expect(err).ToNot(HaveOccurred())
+				if len(inv.Args) > 1 && inv.Args[1] == "-migrate-state" {
+					Expect(string(b)).To(ContainSubstring(`"kubernetes"`))
+				} else {
+					Expect(string(b)).To(ContainSubstring(`"gcs"`))
+					Expect(string(b)).ToNot(ContainSubstring("credentials"))
+				}
+			}
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{
+				"migration/init", "migration/state", "migration/init", "migration/state",
+				"instance/init", "instance/plan", "instance/show", "instance/output",
+			}))
+			Expect(executor.Invocations()[2].Args).To(Equal([]string{"init", "-migrate-state", "-force-copy", "-input=false"}))
+			Expect(filepath.Join(workspaces.Path(req.NamespacedName), "migration")).ShouldNot(BeADirectory())
+
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.Status.Phase).To(Equal(sqlv1alpha1.PhaseRunning))
+			Expect(current.Status.StateLocation).To(Equal("kubernetes://" + namespace + "/tfstate-default-postgresql-my-instance"))
+			Expect(current.Status.StateMigration).ToNot(BeNil())
+			migrated := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, migrated)).To(Succeed())
+			Expect(migrated.GetAnnotations()).ToNot(HaveKey(sqlv1alpha1.MigrateStateAnnotation))
+			Expect(current.Status.StateMigration.From).To(Equal("gs://my-bucket/test/tfstate"))
+			Expect(current.Status.StateMigration.To).To(Equal(current.Status.StateLocation))
+			Expect(current.Status.StateMigration.Serial).To(Equal(int64(7)))
+			Expect(current.Status.StateMigration.Resources).To(Equal(2))
+		})
+
+		It("Should keep the previous backend when the migrated state differs", func() {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.SetAnnotations(map[string]string{sqlv1alpha1.MigrateStateAnnotation: "kubernetes"})
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			executor.On("migration/state", terraform.FakeResponse{Stdout: testPreviousState}, terraform.FakeResponse{Stdout: `{"version": 4, "lineage": "3b7e0f4c", "serial": 1}`})
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(Equal([]string{"migration/init", "migration/state", "migration/init", "migration/state"}))
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.Status.Phase).To(Equal(sqlv1alpha1.PhaseFailed))
+			Expect(current.Status.StateLocation).To(Equal("gs://my-bucket/test/tfstate"))
+			Expect(current.Status.StateMigration).To(BeNil())
+		})
+	})
+
+	Context("With a ProviderConfig", func() {
+		var config *sqlv1alpha1.ProviderConfig
+
+		BeforeEach(func() {
+			config = &sqlv1alpha1.ProviderConfig{
+				ObjectMeta: metav1.ObjectMeta{Name: "shared-" + rand.String(6)},
+				Spec: sqlv1alpha1.ProviderConfigSpec{
+					Project: sqlv1alpha1.PostgresqlInstanceProvider{
+						Name:            "shared-project",
+						Region:          "region-2",
+						Zone:            "zone-2",
+						ProviderVersion: "3.51.0",
+					},
+					RemoteState: sqlv1alpha1.PostgresqlInstanceBackend{
+						BucketName:   "my-bucket",
+						BucketPrefix: "shared",
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, config)).To(Succeed())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.ProviderConfigRef = &sqlv1alpha1.ProviderConfigReference{Name: config.Name}
+			// The region of the PostgreSql overrides the one of the ProviderConfig
+			current.Spec.Project = sqlv1alpha1.PostgresqlInstanceProvider{Region: "region-1"}
+			current.Spec.RemoteState = sqlv1alpha1.PostgresqlInstanceBackend{}
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(ctx, config)).To(Succeed())
+		})
+
+		It("Should render the project and the backend of the ProviderConfig", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseRunning))
+
+			b, err := ioutil.ReadFile(filepath.Join(workspaces.Path(req.NamespacedName), "instance", "provider.tf.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(b)).To(ContainSubstring(`"project": "shared-project"`))
+			Expect(string(b)).To(ContainSubstring(`"region": "region-1"`))
+			Expect(string(b)).To(ContainSubstring(`"zone": "zone-2"`))
+			Expect(string(b)).To(ContainSubstring(`"version": "3.51.0"`))
+			b, err = ioutil.ReadFile(filepath.Join(workspaces.Path(req.NamespacedName), "instance", "backend.tf.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(b)).To(ContainSubstring(`"prefix": "shared/` + namespace + `/my-instance"`))
+
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.Status.StateLocation).To(Equal("gs://my-bucket/shared/" + namespace + "/my-instance"))
+			Expect(current.Finalizers).To(ContainElement(Finalizer))
+		})
+
+		It("Should render the project of the ProviderConfig into the instance, its users and databases", func() {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.SqlInstance.Project = ""
+			current.Spec.Users[0].Project = ""
+			current.Spec.Databases[0].Project = ""
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			b, err := ioutil.ReadFile(filepath.Join(workspaces.Path(req.NamespacedName), "instance", "main.tf.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(strings.Count(string(b), `"project": "shared-project"`)).To(Equal(3))
+		})
+
+		It("Should fail while the ProviderConfig is missing", func() {
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.ProviderConfigRef.Name = "missing"
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(BeEmpty())
+			Expect(phaseOf()).To(Equal(sqlv1alpha1.PhaseFailed))
+		})
+
+		It("Should only delete a PostgreSql whose ProviderConfig is missing once confirmed", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.Spec.ProviderConfigRef.Name = "missing"
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, current)).To(Succeed())
+			executor.Reset()
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			condition := util.GetCondition(current.Status.Conditions, sqlv1alpha1.ConditionProviderConfigNotFound)
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.Status).To(Equal(kubeApiV1.ConditionTrue))
+			Expect(current.Finalizers).To(ContainElement(Finalizer))
+
+			By("ignoring the confirmation of a protected deletion")
+			current.SetAnnotations(map[string]string{sqlv1alpha1.ConfirmDeleteAnnotation: current.Spec.SqlInstance.Name})
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.Finalizers).To(ContainElement(Finalizer))
+
+			By("confirming the abandonment")
+			current.SetAnnotations(map[string]string{sqlv1alpha1.AbandonAnnotation: current.Spec.SqlInstance.Name})
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			_, err = reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(executor.Commands()).To(BeEmpty())
+			Expect(workspaces.Path(req.NamespacedName)).ShouldNot(BeADirectory())
+			Eventually(func() bool {
+				return errors.IsNotFound(k8sClient.Get(ctx, req.NamespacedName, &sqlv1alpha1.PostgreSql{}))
+			}).Should(BeTrue())
+		})
+
+		It("Should not abandon a PostgreSql whose ProviderConfig cannot be read", func() {
+			_, err := reconciler.Reconcile(req)
+			Expect(err).ToNot(HaveOccurred())
+			current := &sqlv1alpha1.PostgreSql{}
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			current.SetAnnotations(map[string]string{sqlv1alpha1.AbandonAnnotation: current.Spec.SqlInstance.Name})
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, current)).To(Succeed())
+			executor.Reset()
+			reconciler.Client = unreadableProviderConfigClient{Client: k8sClient, err: fmt.Errorf("connection refused")}
+
+			_, err = reconciler.Reconcile(req)
+			Expect(err).To(MatchError("connection refused"))
+			Expect(executor.Commands()).To(BeEmpty())
+			Expect(k8sClient.Get(ctx, req.NamespacedName, current)).To(Succeed())
+			Expect(current.Finalizers).To(ContainElement(Finalizer))
+		})
+
+		It("Should let the PostgreSql override the bucket deletion of the ProviderConfig", func() {
+			destroy, keep := true, false
+			config.Spec.BucketConfig.Destroy = &destroy
+			inherited := &sqlv1alpha1.PostgreSql{}
+			inherited.ResolveProviderConfig(config)
+			Expect(inherited.Spec.BucketConfig.GetDestroy()).To(BeTrue())
+			overridden := &sqlv1alpha1.PostgreSql{}
+			overridden.Spec.BucketConfig.Destroy = &keep
+			overridden.ResolveProviderConfig(config)
+			Expect(overridden.Spec.BucketConfig.GetDestroy()).To(BeFalse())
+		})
+
+		It("Should only allow the identity of the operator to the namespaces of its identityPolicies", func() {
+			Expect(config.Spec.AllowsWorkloadIdentity(namespace)).To(BeFalse())
+			Expect(config.Spec.AllowsImpersonation(namespace, "demo@my-project.iam.gserviceaccount.com")).To(BeFalse())
+			config.Spec.IdentityPolicies = []sqlv1alpha1.IdentityPolicy{{
+				Namespaces:                  []string{namespace},
+				ImpersonableServiceAccounts: []string{"demo@my-project.iam.gserviceaccount.com"},
+			}, {
+				Namespaces:       []string{"ops"},
+				WorkloadIdentity: true,
+			}}
+			Expect(config.Spec.AllowsWorkloadIdentity(namespace)).To(BeFalse())
+			Expect(config.Spec.AllowsWorkloadIdentity("ops")).To(BeTrue())
+			Expect(config.Spec.AllowsImpersonation(namespace, "demo@my-project.iam.gserviceaccount.com")).To(BeTrue())
+			Expect(config.Spec.AllowsImpersonation(namespace, "admin@my-project.iam.gserviceaccount.com")).To(BeFalse())
+			Expect(config.Spec.AllowsImpersonation("ops", "demo@my-project.iam.gserviceaccount.com")).To(BeFalse())
+		})
+
+		It("Should reconcile the PostgreSqls referencing a ProviderConfig", func() {
+			Expect(reconciler.PostgreSqlsOfProviderConfig(handler.MapObject{Meta: config, Object: config})).To(Equal([]ctrl.Request{req}))
+		})
+	})
+
+	It("Should work in the workspace of the reconciled PostgreSql", func() {
+		_, err := reconciler.Reconcile(req)
+		Expect(err).ToNot(HaveOccurred())
+		for _, inv := range executor.Invocations() {
+			Expect(filepath.Dir(inv.Dir)).To(Equal(workspaces.Path(req.NamespacedName)))
+		}
+	})
+
+	It("Should collect the workspaces of deleted PostgreSqls", func() {
+		deleted := types.NamespacedName{Namespace: namespace, Name: "deleted-instance"}
+		for _, key := range []types.NamespacedName{req.NamespacedName, deleted} {
+			_, err := workspaces.Create(key)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		collector := &WorkspaceCollector{
+			Client:     k8sClient,
+			Log:        logf.Log.WithName("workspaces"),
+			Workspaces: workspaces,
+		}
+
+		Expect(collector.Collect(ctx)).To(Succeed())
+		Expect(workspaces.Path(req.NamespacedName)).Should(BeADirectory())
+		Expect(workspaces.Path(deleted)).ShouldNot(BeADirectory())
+	})
+})
@@ -0,0 +1,49 @@
+/*
+Copyright 2020 The Terrak8s-operator authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"strings"
+)
+
+// AnnotationChangedPredicate implements an update predicate function on changes of
+// the sql.terrak8s.io annotations, which are used to drive the reconcile
+type AnnotationChangedPredicate struct {
+	predicate.Funcs
+}
+
+// Update implements default UpdateEvent filter for validating terrak8s annotations change
+func (AnnotationChangedPredicate) Update(e event.UpdateEvent) bool {
+	if e.MetaOld == nil || e.MetaNew == nil {
+		return false
+	}
+	return !reflect.DeepEqual(terrak8sAnnotations(e.MetaOld.GetAnnotations()), terrak8sAnnotations(e.MetaNew.GetAnnotations()))
+}
+
+func terrak8sAnnotations(annotations map[string]string) map[string]string {
+	res := make(map[string]string)
+	for k, v := range annotations {
+		if strings.HasPrefix(k, sqlv1alpha1.AnnotationPrefix) {
+			res[k] = v
+		}
+	}
+	return res
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2020 The Terrak8s-operator authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	"github.com/HamzaZo/terrak8s-operator/pkg/util"
+	kubeApiV1 "k8s.io/api/core/v1"
+)
+
+// defaultRetryAfter is the delay before retrying a reconcile which did not fail in terraform,
+// e.g. a missing secret or a locked state
+const defaultRetryAfter = 5 * time.Second
+
+// RetryPolicy is the exponential backoff of a class of terraform failures
+type RetryPolicy struct {
+	// Base is the delay after the first failure, zero disables the retries
+	Base time.Duration
+	// Max bounds the delay
+	Max time.Duration
+}
+
+// RetryPolicies holds the backoff of every class of terraform failures. Permanent failures
+// are not retried, the instance is reconciled again once its spec changes.
+var RetryPolicies = map[terraform.ErrorClass]RetryPolicy{
+	terraform.ErrorTransient: {Base: 5 * time.Second, Max: 5 * time.Minute},
+	terraform.ErrorQuota:     {Base: time.Minute, Max: 30 * time.Minute},
+	terraform.ErrorAuth:      {Base: 5 * time.Minute, Max: time.Hour},
+	terraform.ErrorPermanent: {},
+}
+
+// Delay return the delay before the given retry, starting at 1
+func (p RetryPolicy) Delay(retries int32) time.Duration {
+	delay := p.Base
+	for i := int32(1); i < retries && delay < p.Max; i++ {
+		delay *= 2
+	}
+	if delay > p.Max {
+		return p.Max
+	}
+	return delay
+}
+
+// SetFailure classify a terraform failure and record it in the Failed condition and in the
+// failed stage
+func SetFailure(instance *sqlv1alpha1.PostgreSql, err error) terraform.Failure {
+	failure := terraform.Classify(err)
+	// The state was not locked this time
+	ClearStateLock(instance)
+	failStage(instance)
+	instance.Status.Retries++
+	util.SetCondition(&instance.Status.Conditions, sqlv1alpha1.PostgreSqlCondition{
+		Type:    sqlv1alpha1.ConditionFailed,
+		Status:  kubeApiV1.ConditionTrue,
+		Reason:  string(failure.Class),
+		Message: failure.Message,
+	})
+	return failure
+}
+
+// ClearFailure reset the retries after a successful terraform run
+func ClearFailure(instance *sqlv1alpha1.PostgreSql) {
+	instance.Status.Retries = 0
+	if c := util.GetCondition(instance.Status.Conditions, sqlv1alpha1.ConditionFailed); c != nil && c.Status == kubeApiV1.ConditionTrue {
+		util.SetCondition(&instance.Status.Conditions, sqlv1alpha1.PostgreSqlCondition{
+			Type:    sqlv1alpha1.ConditionFailed,
+			Status:  kubeApiV1.ConditionFalse,
+			Reason:  "Succeeded",
+			Message: "last terraform run succeeded",
+		})
+	}
+}
+
+// RetryAfter return the delay before reconciling the instance again after a failure, zero
+// when it must not be retried
+func RetryAfter(instance *sqlv1alpha1.PostgreSql) time.Duration {
+	if c := util.GetCondition(instance.Status.Conditions, sqlv1alpha1.ConditionStateLocked); c != nil && c.Status == kubeApiV1.ConditionTrue {
+		return defaultRetryAfter
+	}
+	c := util.GetCondition(instance.Status.Conditions, sqlv1alpha1.ConditionFailed)
+	if c == nil || c.Status != kubeApiV1.ConditionTrue {
+		return defaultRetryAfter
+	}
+	policy, ok := RetryPolicies[terraform.ErrorClass(c.Reason)]
+	if !ok {
+		return defaultRetryAfter
+	}
+	return policy.Delay(instance.Status.Retries)
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2020 The Terrak8s-operator authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/HamzaZo/terrak8s-operator/pkg/util"
+	"github.com/HamzaZo/terrak8s-operator/pkg/workspace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Stages are the stages of the reconcile pipeline which apply the spec, in order
+var Stages = []sqlv1alpha1.StageName{
+	sqlv1alpha1.StageBucket,
+	sqlv1alpha1.StageBackend,
+	sqlv1alpha1.StageInstance,
+	sqlv1alpha1.StageOutput,
+}
+
+// stageModules holds the terraform module every stage runs in
+var stageModules = map[sqlv1alpha1.StageName]string{
+	sqlv1alpha1.StageBucket:     "bucket",
+	sqlv1alpha1.StageBackend:    "instance",
+	sqlv1alpha1.StageInstance:   "instance",
+	sqlv1alpha1.StageOutput:     "instance",
+	sqlv1alpha1.StageDriftCheck: "instance",
+}
+
+// StageInputs hash the rendered files every stage depends on. A stage also depends on
+// the inputs of the stages it follows, so that a new backend runs the instance again.
+// The instance depends on the versions of the referenced secrets as well, which hold the
+// passwords passed to its runs.
+func StageInputs(dir string, instance *sqlv1alpha1.PostgreSql, secretVersions []string) (map[sqlv1alpha1.StageName]string, error) {
+	inputs := make(map[sqlv1alpha1.StageName]string)
+	var err error
+	if UsesStateBucket(instance) {
+		inputs[sqlv1alpha1.StageBucket], err = hashFiles("", filepath.Join(dir, "bucket"), "bucket.tf.json", "provider.tf.json")
+		if err != nil {
+			return nil, err
+		}
+	}
+	inputs[sqlv1alpha1.StageBackend], err = hashFiles("", filepath.Join(dir, "instance"), "backend.tf.json", "provider.tf.json")
+	if err != nil {
+		return nil, err
+	}
+	prefix := inputs[sqlv1alpha1.StageBackend] + strconv.FormatBool(instance.Spec.Adopt) + strings.Join(secretVersions, "\x00")
+	inputs[sqlv1alpha1.StageInstance], err = hashFiles(prefix, filepath.Join(dir, "instance"), "main.tf.json")
+	if err != nil {
+		return nil, err
+	}
+	inputs[sqlv1alpha1.StageOutput], err = hashFiles(inputs[sqlv1alpha1.StageInstance], filepath.Join(dir, "instance"), "output.tf")
+	if err != nil {
+		return nil, err
+	}
+	inputs[sqlv1alpha1.StageDriftCheck] = inputs[sqlv1alpha1.StageInstance]
+	return inputs, nil
+}
+
+// UsesStateBucket return whether the states of the instance are stored in a bucket provisioned
+// by the Bucket stage
+func UsesStateBucket(instance *sqlv1alpha1.PostgreSql) bool {
+	return instance.Spec.RemoteState.GetType() == sqlv1alpha1.BackendGCS
+}
+
+// StateModules return the modules of the workspace which hold a state
+func StateModules(instance *sqlv1alpha1.PostgreSql) []string {
+	if !UsesStateBucket(instance) {
+		return []string{"instance"}
+	}
+	return workspace.Modules
+}
+
+func hashFiles(prefix string, dir string, names ...string) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(prefix))
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte("\x00" + name + "\x00"))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// IsStageDone return whether the stage completed with the given inputs, in a workspace
+// which is still initialized
+func IsStageDone(instance *sqlv1alpha1.PostgreSql, dir string, name sqlv1alpha1.StageName, inputHash string) bool {
+	stage := util.GetStage(instance.Status.Stages, name)
+	if stage == nil || stage.Status != sqlv1alpha1.StageCompleted || stage.InputHash != inputHash {
+		return false
+	}
+	// A workspace lost with its volume must be initialized again
+	_, err := os.Stat(filepath.Join(dir, stageModules[name], ".terraform"))
+	return err == nil
+}
+
+// AppliedHash hash the inputs of every stage together with the versions of the secrets
+// referenced by the instance
+func AppliedHash(inputs map[sqlv1alpha1.StageName]string, secretVersions []string) string {
+	h := sha256.New()
+	for _, name := range Stages {
+		h.Write([]byte(string(name) + "=" + inputs[name] + "\x00"))
+	}
+	for _, version := range secretVersions {
+		h.Write([]byte(version + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// IsUpToDate return whether the running instance was last applied with the given hash
+func IsUpToDate(instance *sqlv1alpha1.PostgreSql, appliedHash string) bool {
+	return instance.Status.Phase == sqlv1alpha1.PhaseRunning && instance.Status.LastAppliedHash == appliedHash
+}
+
+// IsStateMigrationRequired return whether the state of the instance is stored somewhere else than location
+func IsStateMigrationRequired(instance *sqlv1alpha1.PostgreSql, location string) bool {
+	return instance.Status.StateLocation != "" && instance.Status.StateLocation != location
+}
+
+// IsStateMigrationConfirmed return whether the migrate-state annotation confirms the migration of the state
+// to the new remoteState
+func IsStateMigrationConfirmed(instance *sqlv1alpha1.PostgreSql) bool {
+	value, ok := instance.GetAnnotations()[sqlv1alpha1.MigrateStateAnnotation]
+	return ok && value == string(instance.Spec.RemoteState.GetType())
+}
+
+// IsReconcileRequested return whether the reconcile annotation asks to run every stage again
+func IsReconcileRequested(instance *sqlv1alpha1.PostgreSql) bool {
+	value, ok := instance.GetAnnotations()[sqlv1alpha1.ReconcileAnnotation]
+	return ok && value != instance.Status.LastReconcileRequest
+}
+
+// StartStage record that a stage is running, it is marked Failed by SetFailure
+func StartStage(instance *sqlv1alpha1.PostgreSql, name sqlv1alpha1.StageName, inputHash string) {
+	util.SetStage(&instance.Status.Stages, sqlv1alpha1.PostgreSqlStage{
+		Name:        name,
+		Status:      sqlv1alpha1.StageInProgress,
+		InputHash:   inputHash,
+		LastRunTime: metav1.Now(),
+	})
+}
+
+// CompleteStage record that a stage succeeded
+func CompleteStage(instance *sqlv1alpha1.PostgreSql, name sqlv1alpha1.StageName) {
+	if stage := util.GetStage(instance.Status.Stages, name); stage != nil {
+		stage.Status = sqlv1alpha1.StageCompleted
+	}
+}
+
+// failStage mark the running stages as Failed
+func failStage(instance *sqlv1alpha1.PostgreSql) {
+	for i := range instance.Status.Stages {
+		if instance.Status.Stages[i].Status == sqlv1alpha1.StageInProgress {
+			instance.Status.Stages[i].Status = sqlv1alpha1.StageFailed
+		}
+	}
+}
+
+// ResetStages forget the progress of a stage and of all the stages following it
+func ResetStages(instance *sqlv1alpha1.PostgreSql, from sqlv1alpha1.StageName) {
+	reset := false
+	for _, name := range Stages {
+		reset = reset || name == from
+		if stage := util.GetStage(instance.Status.Stages, name); reset && stage != nil {
+			stage.InputHash = ""
+		}
+	}
+}
+
+// NextDriftCheck return the delay before the next drift check of an up to date instance,
+// the instance is in sync with its spec since its last output or successful drift check
+func NextDriftCheck(instance *sqlv1alpha1.PostgreSql, interval time.Duration, now time.Time) time.Duration {
+	var last time.Time
+	for _, name := range []sqlv1alpha1.StageName{sqlv1alpha1.StageOutput, sqlv1alpha1.StageDriftCheck} {
+		stage := util.GetStage(instance.Status.Stages, name)
+		if stage != nil && stage.Status == sqlv1alpha1.StageCompleted && stage.LastRunTime.Time.After(last) {
+			last = stage.LastRunTime.Time
+		}
+	}
+	if wait := last.Add(interval).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2020 The Terrak8s-operator authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/HamzaZo/terrak8s-operator/pkg/workspace"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+)
+
+// WorkspaceCollector periodically removes the workspaces left behind by deleted PostgreSqls,
+// e.g. when a PostgreSql is deleted while the manager is down
+type WorkspaceCollector struct {
+	client.Client
+	Log        logr.Logger
+	Workspaces *workspace.Manager
+	// Interval between two collections
+	Interval time.Duration
+}
+
+// Start implements manager.Runnable, the collection runs on the leader only
+func (c *WorkspaceCollector) Start(stop <-chan struct{}) error {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		_ = c.Collect(context.Background())
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect remove the workspaces whose PostgreSql does not exist anymore
+func (c *WorkspaceCollector) Collect(ctx context.Context) error {
+	removed, err := c.Workspaces.GarbageCollect(func(key types.NamespacedName) (bool, error) {
+		err := c.Get(ctx, key, &sqlv1alpha1.PostgreSql{})
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	for _, key := range removed {
+		c.Log.Info("removed the workspace of a deleted PostgreSql", "postgresql", key)
+	}
+	if err != nil {
+		c.Log.Error(err, "failed to collect workspaces")
+	}
+	return err
+}
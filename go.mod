@@ -7,7 +7,6 @@ require (
 	github.com/go-logr/logr v0.3.0
 	github.com/go-logr/zapr v0.3.0
 	github.com/json-iterator/go v1.1.10
-	github.com/mitchellh/mapstructure v1.4.0
 	github.com/onsi/ginkgo v1.12.1
 	github.com/onsi/gomega v1.10.1
 	k8s.io/api v0.18.6
@@ -19,9 +19,12 @@ package main
 import (
 	"flag"
 	"os"
+	"path/filepath"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -29,6 +32,9 @@ import (
 
 	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
 	"github.com/HamzaZo/terrak8s-operator/controllers"
+	"github.com/HamzaZo/terrak8s-operator/pkg/statebackend"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	"github.com/HamzaZo/terrak8s-operator/pkg/workspace"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -47,8 +53,40 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var terraformTimeout time.Duration
+	var driftCheckInterval time.Duration
+	var executorMode string
+	var terraformImage string
+	var workspaceClaim string
+	var jobNamespace string
+	var jobServiceAccount string
+	var workspaceRoot string
+	var stateExportNamespace string
+	var stateBackendBindAddress string
+	var stateBackendAddress string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.DurationVar(&terraformTimeout, "terraform-timeout", terraform.DefaultTimeout,
+		"The maximum duration of a single terraform command.")
+	flag.DurationVar(&driftCheckInterval, "drift-check-interval", time.Hour,
+		"The default period between two drift checks of a PostgreSql, 0 disables them.")
+	flag.StringVar(&workspaceRoot, "workspace-root", filepath.Join(os.TempDir(), "terrak8s"),
+		"The directory holding the terraform workspaces, e.g. a PersistentVolumeClaim mount.")
+	flag.StringVar(&executorMode, "executor", "local",
+		"Where terraform runs: local runs it inside the manager, job runs every command as a Kubernetes Job.")
+	flag.StringVar(&terraformImage, "terraform-image", terraform.DefaultImage, "The terraform image of the Jobs.")
+	flag.StringVar(&workspaceClaim, "workspace-claim", "",
+		"The ReadWriteMany PersistentVolumeClaim mounted at --workspace-root. Required by the job executor.")
+	flag.StringVar(&jobNamespace, "job-namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace of the Jobs and of the workspace claim, defaults to the manager namespace.")
+	flag.StringVar(&jobServiceAccount, "job-service-account", "",
+		"The service account of the Jobs, e.g. bound to a GCP service account by Workload Identity. Defaults to the default service account of --job-namespace.")
+	flag.StringVar(&stateExportNamespace, "state-export-namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace of the states exported by the Orphan deletion policy, defaults to the manager namespace.")
+	flag.StringVar(&stateBackendBindAddress, "state-backend-bind-address", ":8082",
+		"The address the terraform http backend binds to, 0 disables it.")
+	flag.StringVar(&stateBackendAddress, "state-backend-address", "http://127.0.0.1:8082",
+		"The address at which terraform reaches the http backend, e.g. the address of the manager service with the job executor.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -69,15 +107,75 @@ func main() {
 		os.Exit(1)
 	}
 
+	workspaces := workspace.NewManager(workspaceRoot)
+	var executor terraform.Executor
+	switch executorMode {
+	case "local":
+		executor = terraform.NewRunner(terraformTimeout)
+	case "job":
+		if workspaceClaim == "" || jobNamespace == "" {
+			setupLog.Info("the job executor requires --workspace-claim and --job-namespace")
+			os.Exit(1)
+		}
+		clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+		if err != nil {
+			setupLog.Error(err, "unable to create clientset")
+			os.Exit(1)
+		}
+		executor = &terraform.JobExecutor{
+			Client:         mgr.GetClient(),
+			Logs:           terraform.ClientsetJobLogs(clientset),
+			Log:            ctrl.Log.WithName("terraform").WithName("job"),
+			Namespace:      jobNamespace,
+			Image:          terraformImage,
+			ServiceAccount: jobServiceAccount,
+			VolumeClaim:    workspaceClaim,
+			WorkspaceRoot:  workspaceRoot,
+			User:           int64(os.Getuid()),
+			Group:          int64(os.Getgid()),
+			Timeout:        terraformTimeout,
+		}
+	default:
+		setupLog.Info("unknown executor, must be local or job", "executor", executorMode)
+		os.Exit(1)
+	}
+
+	if stateBackendBindAddress == "0" {
+		stateBackendAddress = ""
+	} else if err = mgr.Add(&statebackend.Server{
+		Client:      mgr.GetClient(),
+		Reader:      mgr.GetAPIReader(),
+		Log:         ctrl.Log.WithName("statebackend"),
+		BindAddress: stateBackendBindAddress,
+		Retained:    sqlv1alpha1.DefaultRetainedStateVersions,
+	}); err != nil {
+		setupLog.Error(err, "unable to create the terraform http backend")
+		os.Exit(1)
+	}
 	if err = (&controllers.PostgreSqlReconciler{
-		Client:   mgr.GetClient(),
-		Log:      ctrl.Log.WithName("controllers").WithName("PostgreSql"),
-		Scheme:   mgr.GetScheme(),
-		Recorder: mgr.GetEventRecorderFor("sql-controller"),
+		Client:               mgr.GetClient(),
+		Log:                  ctrl.Log.WithName("controllers").WithName("PostgreSql"),
+		Scheme:               mgr.GetScheme(),
+		Recorder:             mgr.GetEventRecorderFor("sql-controller"),
+		Executor:             executor,
+		DriftCheckInterval:   driftCheckInterval,
+		Workspaces:           workspaces,
+		StateExportNamespace: stateExportNamespace,
+		StateBackendAddress:  stateBackendAddress,
+		APIReader:            mgr.GetAPIReader(),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PostgreSql")
 		os.Exit(1)
 	}
+	if err = mgr.Add(&controllers.WorkspaceCollector{
+		Client:     mgr.GetClient(),
+		Log:        ctrl.Log.WithName("controllers").WithName("WorkspaceCollector"),
+		Workspaces: workspaces,
+		Interval:   time.Hour,
+	}); err != nil {
+		setupLog.Error(err, "unable to create workspace collector")
+		os.Exit(1)
+	}
 	// TIPS: comment the webhook to be able to run the controller locally
 	if err = (&sqlv1alpha1.PostgreSql{}).SetupWebhookWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create webhook", "webhook", "PostgreSql")
@@ -0,0 +1,225 @@
+package statebackend
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/go-logr/logr"
+	kubeApiV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// PathPrefix precedes <namespace>/<name> in the address of a state
+	PathPrefix = "/state/"
+
+	methodLock   = "LOCK"
+	methodUnlock = "UNLOCK"
+	// maxStateSize bounds the states, a Secret holds at most 1MiB
+	maxStateSize = 512 << 10
+)
+
+// lockInfo is the part of the lock info of terraform checked by the backend
+type lockInfo struct {
+	ID string `json:"ID"`
+}
+
+// Server serves the terraform http backend of the PostgreSqls, with the GET, POST, LOCK and UNLOCK
+// methods. Every state is stored in a Secret owned by its PostgreSql together with its lock and the
+// previous states, terraform authenticates with the token of the Secret.
+type Server struct {
+	// Client writes the state Secrets
+	Client client.Client
+	// Reader reads the state Secrets, it must not be cached so that terraform reads its own writes
+	Reader client.Reader
+	Log    logr.Logger
+	// BindAddress is the address the backend binds to
+	BindAddress string
+	// Retained is the number of previous states kept in a Secret
+	Retained int
+}
+
+// Start implements manager.Runnable
+func (s *Server) Start(stop <-chan struct{}) error {
+	srv := &http.Server{Addr: s.BindAddress, Handler: s}
+	go func() {
+		<-stop
+		_ = srv.Shutdown(context.Background())
+	}()
+	s.Log.Info("serving the terraform http backend", "address", s.BindAddress)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica serves the states
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, PathPrefix), "/")
+	if !strings.HasPrefix(r.URL.Path, PathPrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	secret := &kubeApiV1.Secret{}
+	err := s.Reader.Get(ctx, client.ObjectKey{Namespace: parts[0], Name: SecretName(parts[1])}, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		s.Log.Error(err, "failed to read the state", "namespace", parts[0], "name", parts[1])
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// A missing Secret is not told apart from a wrong token
+	user, password, ok := r.BasicAuth()
+	token := secret.Data[TokenKey]
+	if err != nil || !ok || user != Username || len(token) == 0 || subtle.ConstantTimeCompare([]byte(password), token) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="terrak8s"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.get(w, secret)
+	case http.MethodPost:
+		s.post(w, r, secret)
+	case methodLock:
+		s.lock(w, r, secret)
+	case methodUnlock:
+		s.unlock(w, r, secret)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// get write the current state, terraform reads a 404 as an empty state
+func (s *Server) get(w http.ResponseWriter, secret *kubeApiV1.Secret) {
+	state, ok := secret.Data[StateKey]
+	if !ok || len(state) == 0 {
+		http.NotFound(w, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(state)
+}
+
+// post save a new state, older serials of the same lineage are rejected
+func (s *Server) post(w http.ResponseWriter, r *http.Request, secret *kubeApiV1.Secret) {
+	if lock, ok := secret.Data[LockKey]; ok && heldLock(lock) != r.URL.Query().Get("ID") {
+		writeLock(w, lock)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxStateSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	state := &State{}
+	if err = json.Unmarshal(body, state); err != nil {
+		http.Error(w, "invalid state "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	current, err := ReadState(secret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if current != nil && current.Lineage != state.Lineage {
+		http.Error(w, "state lineage "+state.Lineage+" differs from the current lineage "+current.Lineage, http.StatusConflict)
+		return
+	}
+	if current != nil && state.Serial < current.Serial {
+		http.Error(w, "state serial is older than the current serial", http.StatusConflict)
+		return
+	}
+	keepHistory(secret, current, s.Retained, len(body))
+	secret.Data[StateKey] = body
+	s.update(w, secret)
+}
+
+// lock hold the state lock for the lock info of the body, or write the lock already held
+func (s *Server) lock(w http.ResponseWriter, r *http.Request, secret *kubeApiV1.Secret) {
+	if lock, ok := secret.Data[LockKey]; ok {
+		writeLock(w, lock)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxStateSize))
+	if err != nil || heldLock(body) == "" {
+		http.Error(w, "invalid lock info", http.StatusBadRequest)
+		return
+	}
+	secret.Data[LockKey] = body
+	s.update(w, secret)
+}
+
+// unlock release the state lock, terraform force-unlock does not send the lock info
+func (s *Server) unlock(w http.ResponseWriter, r *http.Request, secret *kubeApiV1.Secret) {
+	lock, ok := secret.Data[LockKey]
+	if !ok {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxStateSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 && heldLock(body) != heldLock(lock) {
+		writeLock(w, lock)
+		return
+	}
+	delete(secret.Data, LockKey)
+	s.update(w, secret)
+}
+
+// update save the Secret read by the request, a concurrent write is reported as a conflict
+func (s *Server) update(w http.ResponseWriter, secret *kubeApiV1.Secret) {
+	err := s.Client.Update(context.Background(), secret)
+	if errors.IsConflict(err) {
+		http.Error(w, "the state has been written concurrently", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.Log.Error(err, "failed to save the state", "namespace", secret.Namespace, "name", secret.Name)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeLock answer with the lock held, terraform reports its ID
+func writeLock(w http.ResponseWriter, lock []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusLocked)
+	_, _ = w.Write(lock)
+}
+
+func heldLock(b []byte) string {
+	info := lockInfo{}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return ""
+	}
+	return info.ID
+}
+
+// StateOf return the current state of a PostgreSql served by the backend, nil when there is none
+func StateOf(ctx context.Context, reader client.Reader, instance *sqlv1alpha1.PostgreSql) (*State, error) {
+	secret := &kubeApiV1.Secret{}
+	err := reader.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: SecretName(instance.Name)}, secret)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ReadState(secret)
+}
@@ -0,0 +1,184 @@
+package statebackend_test
+
+import (
+	"context"
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/HamzaZo/terrak8s-operator/pkg/statebackend"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	kubeApiV1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"net/http"
+	"net/http/httptest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"strings"
+)
+
+const (
+	testState    = `{"version": 4, "lineage": "3b7e0f4c", "serial": 3, "outputs": {}}`
+	testNewState = `{"version": 4, "lineage": "3b7e0f4c", "serial": 4, "outputs": {}}`
+	testLock     = `{"ID": "9db59ba3-8ea3-2d81-7d40-7e1d2e2e7c55", "Operation": "OperationTypeApply"}`
+	testLockID   = "9db59ba3-8ea3-2d81-7d40-7e1d2e2e7c55"
+)
+
+var _ = Describe("Server", func() {
+	var (
+		ctx       context.Context
+		k8sClient client.Client
+		instance  *sqlv1alpha1.PostgreSql
+		endpoint  *terraform.StateEndpoint
+		server    *httptest.Server
+		err       error
+	)
+
+	do := func(method, url, body string) (int, string) {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		req.SetBasicAuth(endpoint.Username, endpoint.Password)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return resp.StatusCode, string(b)
+	}
+
+	stateSecret := func() *kubeApiV1.Secret {
+		secret := &kubeApiV1.Secret{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: "demo", Name: "my-instance-tfstate"}, secret)).To(Succeed())
+		return secret
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		scheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(sqlv1alpha1.AddToScheme(scheme)).To(Succeed())
+		instance = &sqlv1alpha1.PostgreSql{ObjectMeta: metav1.ObjectMeta{Name: "my-instance", Namespace: "demo", UID: "1234"}}
+		k8sClient = fake.NewFakeClientWithScheme(scheme, instance)
+		server = httptest.NewServer(&statebackend.Server{
+			Client:   k8sClient,
+			Reader:   k8sClient,
+			Log:      logf.Log.WithName("statebackend"),
+			Retained: 2,
+		})
+		endpoint, err = statebackend.EnsureSecret(ctx, k8sClient, scheme, instance, server.URL+"/")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("Should create a state secret owned by the instance", func() {
+		Expect(endpoint.Address).To(Equal(server.URL + "/state/demo/my-instance"))
+		Expect(endpoint.Password).To(HaveLen(64))
+		secret := stateSecret()
+		Expect(secret.Labels).To(HaveKeyWithValue(terraform.StateLabel, "my-instance"))
+		Expect(secret.OwnerReferences).To(HaveLen(1))
+		Expect(secret.OwnerReferences[0].Name).To(Equal("my-instance"))
+
+		again, err := statebackend.EnsureSecret(ctx, k8sClient, clientgoscheme.Scheme, instance, server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(again).To(Equal(endpoint))
+	})
+
+	It("Should reject the runs without the token of the instance", func() {
+		endpoint.Password = "wrong"
+		code, _ := do(http.MethodGet, endpoint.Address, "")
+		Expect(code).To(Equal(http.StatusUnauthorized))
+		code, _ = do(http.MethodGet, server.URL+"/state/demo/other-instance", "")
+		Expect(code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("Should store the posted state", func() {
+		code, _ := do(http.MethodGet, endpoint.Address, "")
+		Expect(code).To(Equal(http.StatusNotFound))
+
+		code, _ = do(http.MethodPost, endpoint.Address, testState)
+		Expect(code).To(Equal(http.StatusOK))
+		code, body := do(http.MethodGet, endpoint.Address, "")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(body).To(Equal(testState))
+	})
+
+	It("Should reject older serials and other lineages", func() {
+		code, _ := do(http.MethodPost, endpoint.Address, testNewState)
+		Expect(code).To(Equal(http.StatusOK))
+		code, _ = do(http.MethodPost, endpoint.Address, testState)
+		Expect(code).To(Equal(http.StatusConflict))
+		code, _ = do(http.MethodPost, endpoint.Address, `{"version": 4, "lineage": "other", "serial": 5}`)
+		Expect(code).To(Equal(http.StatusConflict))
+	})
+
+	It("Should keep the retained previous states", func() {
+		for _, serial := range []string{"1", "2", "3", "4"} {
+			code, _ := do(http.MethodPost, endpoint.Address, `{"lineage": "3b7e0f4c", "serial": `+serial+`}`)
+			Expect(code).To(Equal(http.StatusOK))
+		}
+		secret := stateSecret()
+		Expect(statebackend.History(secret)).To(Equal([]int64{2, 3}))
+		state, err := statebackend.ReadState(secret)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Serial).To(Equal(int64(4)))
+	})
+
+	It("Should drop the previous states which do not fit in the Secret", func() {
+		padding := strings.Repeat("x", 400<<10)
+		for _, serial := range []string{"1", "2", "3"} {
+			code, _ := do(http.MethodPost, endpoint.Address, `{"lineage": "3b7e0f4c", "serial": `+serial+`, "padding": "`+padding+`"}`)
+			Expect(code).To(Equal(http.StatusOK))
+		}
+		secret := stateSecret()
+		Expect(statebackend.History(secret)).To(Equal([]int64{2}))
+		size := 0
+		for _, value := range secret.Data {
+			size += len(value)
+		}
+		Expect(size).To(BeNumerically("<", 1<<20))
+	})
+
+	It("Should only let the lock holder write the state", func() {
+		code, _ := do("LOCK", endpoint.Address, testLock)
+		Expect(code).To(Equal(http.StatusOK))
+		code, body := do("LOCK", endpoint.Address, `{"ID": "other"}`)
+		Expect(code).To(Equal(http.StatusLocked))
+		Expect(body).To(MatchJSON(testLock))
+
+		code, _ = do(http.MethodPost, endpoint.Address, testState)
+		Expect(code).To(Equal(http.StatusLocked))
+		code, _ = do(http.MethodPost, endpoint.Address+"?ID="+testLockID, testState)
+		Expect(code).To(Equal(http.StatusOK))
+
+		code, _ = do("UNLOCK", endpoint.Address, `{"ID": "other"}`)
+		Expect(code).To(Equal(http.StatusLocked))
+		code, _ = do("UNLOCK", endpoint.Address, testLock)
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(stateSecret().Data).ToNot(HaveKey(statebackend.LockKey))
+	})
+
+	It("Should force-unlock without the lock info", func() {
+		code, _ := do("LOCK", endpoint.Address, testLock)
+		Expect(code).To(Equal(http.StatusOK))
+		code, _ = do("UNLOCK", endpoint.Address, "")
+		Expect(code).To(Equal(http.StatusOK))
+		code, _ = do("LOCK", endpoint.Address, `{"ID": "other"}`)
+		Expect(code).To(Equal(http.StatusOK))
+	})
+
+	It("Should release the state secret of a retained instance", func() {
+		Expect(statebackend.Release(ctx, k8sClient, instance)).To(Succeed())
+		Expect(stateSecret().OwnerReferences).To(BeEmpty())
+
+		By("refusing the released secret to a new instance of the same name")
+		_, err := statebackend.EnsureSecret(ctx, k8sClient, clientgoscheme.Scheme, instance, server.URL)
+		Expect(err).To(BeAssignableToTypeOf(&statebackend.NotOwnedError{}))
+	})
+})
@@ -0,0 +1,13 @@
+package statebackend_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestStateBackend(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "StateBackend Suite")
+}
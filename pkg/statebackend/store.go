@@ -0,0 +1,183 @@
+package statebackend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	kubeApiV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// StateKey holds the current state in the state Secret
+	StateKey = "tfstate"
+	// LockKey holds the lock info of the terraform run holding the state lock
+	LockKey = "lock.json"
+	// TokenKey holds the password of the terraform runs of the PostgreSql
+	TokenKey = "token"
+	// Username of the terraform runs
+	Username = "terrak8s"
+	// historyPrefix prefixes the keys of the previous states, followed by their serial
+	historyPrefix = StateKey + "."
+	// maxSecretSize is the size limit of a Secret, secretOverhead is kept for the token, the lock
+	// and the metadata of the state Secret
+	maxSecretSize  = 1 << 20
+	secretOverhead = 16 << 10
+)
+
+// State is the part of a terraform state checked by the backend
+type State struct {
+	Lineage string `json:"lineage"`
+	Serial  int64  `json:"serial"`
+	// Outputs holds the outputs of the root module, in the format of terraform output -json
+	Outputs json.RawMessage `json:"outputs"`
+}
+
+// SecretName return the name of the Secret holding the state of a PostgreSql
+func SecretName(name string) string {
+	return name + "-tfstate"
+}
+
+// Address return the address of the state of a PostgreSql, served at the base address of the manager
+func Address(base, namespace, name string) string {
+	return strings.TrimSuffix(base, "/") + PathPrefix + namespace + "/" + name
+}
+
+// NotOwnedError is returned by EnsureSecret when the state Secret of an instance exists without being
+// controlled by the instance, e.g. a Secret left behind by a retained PostgreSql of the same name
+type NotOwnedError struct {
+	Namespace string
+	Name      string
+}
+
+func (e *NotOwnedError) Error() string {
+	return fmt.Sprintf("secret %s/%s exists and is not owned by the PostgreSql", e.Namespace, e.Name)
+}
+
+// EnsureSecret create the Secret holding the state of the instance, owned by the instance, and return
+// the endpoint of its state. A Secret which is not owned by the instance is never used
+func EnsureSecret(ctx context.Context, c client.Client, scheme *runtime.Scheme, instance *sqlv1alpha1.PostgreSql, base string) (*terraform.StateEndpoint, error) {
+	secret := &kubeApiV1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: SecretName(instance.Name)}, secret)
+	if errors.IsNotFound(err) {
+		secret = &kubeApiV1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      SecretName(instance.Name),
+				Namespace: instance.Namespace,
+				Labels:    map[string]string{terraform.StateLabel: instance.Name},
+			},
+			Data: make(map[string][]byte),
+		}
+		if err = controllerutil.SetControllerReference(instance, secret, scheme); err != nil {
+			return nil, err
+		}
+		secret.Data[TokenKey], err = newToken()
+		if err != nil {
+			return nil, err
+		}
+		err = c.Create(ctx, secret)
+	} else if err == nil && !metav1.IsControlledBy(secret, instance) {
+		return nil, &NotOwnedError{Namespace: secret.Namespace, Name: secret.Name}
+	} else if err == nil && len(secret.Data[TokenKey]) == 0 {
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		secret.Data[TokenKey], err = newToken()
+		if err != nil {
+			return nil, err
+		}
+		err = c.Update(ctx, secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &terraform.StateEndpoint{
+		Address:  Address(base, instance.Namespace, instance.Name),
+		Username: Username,
+		Password: string(secret.Data[TokenKey]),
+	}, nil
+}
+
+// Release remove the owner of the state Secret, so that the state survives the deletion of the instance
+func Release(ctx context.Context, c client.Client, instance *sqlv1alpha1.PostgreSql) error {
+	secret := &kubeApiV1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: instance.Namespace, Name: SecretName(instance.Name)}, secret)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	secret.OwnerReferences = nil
+	return c.Update(ctx, secret)
+}
+
+// ReadState return the current state held by the state Secret, nil when there is none
+func ReadState(secret *kubeApiV1.Secret) (*State, error) {
+	b, ok := secret.Data[StateKey]
+	if !ok || len(b) == 0 {
+		return nil, nil
+	}
+	state := &State{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("failed to decode the state of %s/%s %v", secret.Namespace, secret.Name, err)
+	}
+	return state, nil
+}
+
+// History return the serials of the previous states held by the state Secret, oldest first
+func History(secret *kubeApiV1.Secret) []int64 {
+	var serials []int64
+	for key := range secret.Data {
+		if !strings.HasPrefix(key, historyPrefix) {
+			continue
+		}
+		serial, err := strconv.ParseInt(strings.TrimPrefix(key, historyPrefix), 10, 64)
+		if err == nil {
+			serials = append(serials, serial)
+		}
+	}
+	sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+	return serials
+}
+
+// keepHistory move the current state to the history of the Secret and drop the oldest states beyond
+// retained, or beyond the size left in the Secret by the next state of size bytes
+func keepHistory(secret *kubeApiV1.Secret, current *State, retained int, size int) {
+	if current != nil {
+		secret.Data[historyPrefix+strconv.FormatInt(current.Serial, 10)] = secret.Data[StateKey]
+	}
+	serials := History(secret)
+	total := 0
+	for _, serial := range serials {
+		total += len(secret.Data[historyPrefix+strconv.FormatInt(serial, 10)])
+	}
+	for i := 0; i < len(serials); i++ {
+		if len(serials)-i <= retained && total <= maxSecretSize-secretOverhead-size {
+			break
+		}
+		key := historyPrefix + strconv.FormatInt(serials[i], 10)
+		total -= len(secret.Data[key])
+		delete(secret.Data, key)
+	}
+}
+
+func newToken() ([]byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(b)), nil
+}
@@ -0,0 +1,101 @@
+package terraform
+
+import (
+	"strings"
+)
+
+// ErrorClass sorts terraform failures by how they should be retried, its value is
+// used as the reason of the Failed condition
+type ErrorClass string
+
+const (
+	// ErrorTransient is a failure which is likely to succeed when retried, e.g. a timeout
+	ErrorTransient ErrorClass = "TransientError"
+	// ErrorQuota is a quota or rate limit failure, retrying must wait for it to refill
+	ErrorQuota ErrorClass = "QuotaExceeded"
+	// ErrorAuth is a credentials or permission failure
+	ErrorAuth ErrorClass = "AuthenticationFailed"
+	// ErrorPermanent is a configuration failure which only a spec change can fix
+	ErrorPermanent ErrorClass = "InvalidConfiguration"
+)
+
+// errorPatterns are matched in order against the lower cased stderr of terraform, the
+// quota patterns come first as GCP reports some rate limits with a 403, and the transient
+// ones before the permanent ones as GCP reports a concurrent operation with a 409
+var errorPatterns = []struct {
+	class    ErrorClass
+	patterns []string
+}{
+	{ErrorTransient, []string{
+		"operationinprogress",
+		"operation in progress",
+	}},
+	{ErrorQuota, []string{
+		"error 429",
+		"ratelimitexceeded",
+		"quotaexceeded",
+		"quota exceeded",
+		"resource_exhausted",
+		"too many requests",
+	}},
+	{ErrorAuth, []string{
+		"error 401",
+		"error 403",
+		"could not find default credentials",
+		"invalid_grant",
+		"oauth2: cannot fetch token",
+		"permission_denied",
+		"does not have permission",
+		"forbidden",
+	}},
+	{ErrorPermanent, []string{
+		"error 400",
+		"already exists",
+		"invalid value",
+		"error: invalid",
+		"unsupported argument",
+		"unsupported attribute",
+		"missing required argument",
+	}},
+}
+
+// Failure is a classified terraform failure
+type Failure struct {
+	Class ErrorClass
+	// Message is the first terraform diagnostic, or the error itself
+	Message string
+}
+
+// Classify sort err into an ErrorClass, errors which are not reported by terraform
+// itself, e.g. an interrupted run, are transient
+func Classify(err error) Failure {
+	tfErr, ok := err.(*Error)
+	if !ok {
+		return Failure{Class: ErrorTransient, Message: err.Error()}
+	}
+	failure := Failure{Class: ErrorTransient, Message: diagnostic(tfErr)}
+	stderr := strings.ToLower(tfErr.Stderr)
+	for _, p := range errorPatterns {
+		for _, pattern := range p.patterns {
+			if strings.Contains(stderr, pattern) {
+				failure.Class = p.class
+				return failure
+			}
+		}
+	}
+	return failure
+}
+
+// diagnostic return the summary of the first error diagnostic of terraform
+func diagnostic(err *Error) string {
+	for _, line := range strings.Split(err.Stderr, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Error: ") {
+			return strings.TrimPrefix(line, "Error: ")
+		}
+	}
+	if msg := strings.TrimSpace(err.Stderr); msg != "" {
+		return msg
+	}
+	return err.Error()
+}
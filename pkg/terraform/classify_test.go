@@ -0,0 +1,38 @@
+package terraform_test
+
+import (
+	"fmt"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Classify", func() {
+	classOf := func(stderr string) terraform.ErrorClass {
+		return terraform.Classify(&terraform.Error{Command: "apply", ExitCode: 1, Stderr: stderr}).Class
+	}
+
+	It("Should sort terraform diagnostics by error class", func() {
+		Expect(classOf("Error: googleapi: Error 503: The service is currently unavailable., backendError")).To(Equal(terraform.ErrorTransient))
+		Expect(classOf("Error: Error waiting for Create Instance: timeout while waiting for state to become 'DONE'")).To(Equal(terraform.ErrorTransient))
+		Expect(classOf("Error: googleapi: Error 429: Quota exceeded for quota metric 'Queries', rateLimitExceeded")).To(Equal(terraform.ErrorQuota))
+		Expect(classOf("Error: googleapi: Error 403: Rate Limit Exceeded, rateLimitExceeded")).To(Equal(terraform.ErrorQuota))
+		Expect(classOf("Error: googleapi: Error 403: The client is not authorized to make this request., notAuthorized")).To(Equal(terraform.ErrorAuth))
+		Expect(classOf("Error: google: could not find default credentials.")).To(Equal(terraform.ErrorAuth))
+		Expect(classOf("Error: googleapi: Error 400: Invalid request: Invalid Tier (db-f1-mikro) for (POSTGRES_9_6) Project., invalid")).To(Equal(terraform.ErrorPermanent))
+		Expect(classOf("Error: Unsupported argument\n\n  on instance.tf.json line 1")).To(Equal(terraform.ErrorPermanent))
+		Expect(classOf("Error: googleapi: Error 409: Operation failed because another operation was already in progress., operationInProgress")).To(Equal(terraform.ErrorTransient))
+		Expect(classOf("Error: googleapi: Error 409: The Cloud SQL instance already exists., instanceAlreadyExists")).To(Equal(terraform.ErrorPermanent))
+	})
+
+	It("Should consider errors from outside terraform transient", func() {
+		failure := terraform.Classify(fmt.Errorf("terraform apply interrupted after 30m0s"))
+		Expect(failure.Class).To(Equal(terraform.ErrorTransient))
+		Expect(failure.Message).To(Equal("terraform apply interrupted after 30m0s"))
+	})
+
+	It("Should report the first error diagnostic", func() {
+		failure := terraform.Classify(&terraform.Error{Command: "apply", ExitCode: 1, Stderr: "\nError: Unsupported argument\n\n  on instance.tf.json line 1\n\nError: Missing required argument\n"})
+		Expect(failure.Message).To(Equal("Unsupported argument"))
+	})
+})
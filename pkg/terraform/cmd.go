@@ -2,59 +2,221 @@ package terraform
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-var (
-	stdout, stderr bytes.Buffer
+const (
+	// DefaultBinary is the terraform binary looked up in PATH
+	DefaultBinary = "terraform"
+	// DefaultTimeout bounds a single terraform invocation when none is given
+	DefaultTimeout = 30 * time.Minute
+	// killGracePeriod is the time given to terraform to exit after an interrupt
+	killGracePeriod = 10 * time.Second
+	// Redacted replaces the secret values in the output of terraform
+	Redacted = "<redacted>"
+	// minSecretLength is the length under which a value is too common to be redacted
+	minSecretLength = 4
 )
 
-func terraform(tmpPath string, args ...string) (string, error) {
-	cmd := exec.Command("terraform", args...)
-	cmd.Dir = tmpPath
+// Invocation describe a single terraform run
+type Invocation struct {
+	// Dir is the working directory of the run
+	Dir string
+	// Env holds additional environment variables, only visible to this run
+	Env []string
+	// Timeout bounds the run, the runner default is used when zero
+	Timeout time.Duration
+	// Args are the terraform command line arguments
+	Args []string
+}
+
+// Result holds the outcome of a single terraform run
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// Error is returned when terraform exits with a non zero code
+type Error struct {
+	Command  string
+	ExitCode int
+	Stderr   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("failed to execute terraform %s: %v", e.Command, e.Stderr)
+}
+
+// Executor runs terraform invocations, the Runner is the default implementation
+type Executor interface {
+	Run(ctx context.Context, inv Invocation) (*Result, error)
+}
+
+// Runner executes terraform as a child process
+type Runner struct {
+	// Binary is the terraform binary to execute
+	Binary string
+	// Timeout is applied to invocations which do not set their own
+	Timeout time.Duration
+}
+
+// NewRunner return a Runner executing the terraform binary found in PATH
+func NewRunner(timeout time.Duration) *Runner {
+	return &Runner{
+		Binary:  DefaultBinary,
+		Timeout: timeout,
+	}
+}
+
+// Run execute terraform with its own output buffers, the whole process group is
+// killed once ctx is cancelled or the timeout expires
+func (r *Runner) Run(ctx context.Context, inv Invocation) (*Result, error) {
+	timeout := inv.Timeout
+	if timeout == 0 {
+		timeout = r.Timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	binary := r.Binary
+	if binary == "" {
+		binary = DefaultBinary
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(binary, inv.Args...)
+	cmd.Dir = inv.Dir
+	cmd.Env = append(os.Environ(), inv.Env...)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
-	err := cmd.Run()
+	setProcessGroup(cmd)
+
+	command := strings.Join(inv.Args, " ")
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start terraform %s: %v", command, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		interruptProcessGroup(cmd)
+		select {
+		case <-done:
+		case <-time.After(killGracePeriod):
+			killProcessGroup(cmd)
+			<-done
+		}
+		return &Result{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: -1},
+			fmt.Errorf("terraform %s interrupted: %v", command, ctx.Err())
+	}
+
+	res := &Result{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: cmd.ProcessState.ExitCode(),
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to execute terraform %v", stderr.String())
+		return res, &Error{Command: command, ExitCode: res.ExitCode, Stderr: res.Stderr}
 	}
 
-	return stdout.String(), nil
+	return res, nil
 }
 
-func Init(tmpPath string) error {
-	_, err := terraform(tmpPath, "init", "-reconfigure", "-input=false")
+func terraform(ctx context.Context, e Executor, dir string, env []string, args ...string) (string, error) {
+	res, err := e.Run(ctx, Invocation{
+		Dir:  dir,
+		Env:  env,
+		Args: args,
+	})
+	if err != nil {
+		return "", scrubError(err, env)
+	}
+
+	return res.Stdout, nil
+}
+
+// Scrub redact the values of env found in s. The environment of a run only holds credentials and passwords,
+// so that its values must never reach the logs, the events or the status of a PostgreSql
+func Scrub(s string, env []string) string {
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		if i < 0 || len(kv)-i-1 < minSecretLength {
+			continue
+		}
+		s = strings.ReplaceAll(s, kv[i+1:], Redacted)
+	}
+	return s
+}
+
+// scrubError redact the values of env found in err, a terraform Error keeps its type
+func scrubError(err error, env []string) error {
+	if tfErr, ok := err.(*Error); ok {
+		return &Error{Command: tfErr.Command, ExitCode: tfErr.ExitCode, Stderr: Scrub(tfErr.Stderr, env)}
+	}
+	if msg := Scrub(err.Error(), env); msg != err.Error() {
+		return errors.New(msg)
+	}
+	return err
+}
+
+func Init(ctx context.Context, e Executor, dir string, env []string) error {
+	_, err := terraform(ctx, e, dir, env, "init", "-reconfigure", "-input=false")
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func Apply(tmpPath string) error {
-	_, err := terraform(tmpPath, "apply", "-input=false", "-auto-approve", "-lock=false")
+// MigrateState initialize the module in dir with its new backend, copying the state from the backend
+// it was initialized with
+func MigrateState(ctx context.Context, e Executor, dir string, env []string) error {
+	_, err := terraform(ctx, e, dir, env, "init", "-migrate-state", "-force-copy", "-input=false")
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func Output(tmpPath string) (string, error) {
-	out, err := terraform(tmpPath, "output", "-json")
+func Apply(ctx context.Context, e Executor, dir string, env []string) error {
+	_, err := terraform(ctx, e, dir, env, "apply", "-input=false", "-auto-approve")
 	if err != nil {
-		return "", err
+		return err
 	}
-	return out, nil
+	return nil
 }
 
-func Destroy(tmpPath string) error {
-	targets := []string{"instance", "bucket"}
-	for _, k := range targets {
-		_, err := terraform(filepath.Join(tmpPath, k), "destroy", "-input=false", "-auto-approve")
+// Destroy destroy the given modules of the workspace, in order
+func Destroy(ctx context.Context, e Executor, dir string, env []string, modules ...string) error {
+	for _, k := range modules {
+		_, err := terraform(ctx, e, filepath.Join(dir, k), env, "destroy", "-input=false", "-auto-approve")
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// StatePull return the state of the module in dir, wherever its backend stores it
+func StatePull(ctx context.Context, e Executor, dir string, env []string) ([]byte, error) {
+	out, err := terraform(ctx, e, dir, env, "state", "pull")
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
@@ -0,0 +1,146 @@
+package terraform_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Runner", func() {
+	var (
+		dir    string
+		runner *terraform.Runner
+		err    error
+	)
+	script := `#!/bin/sh
+case "$1" in
+  echo)
+    echo "stdout $2"
+    echo "stderr $2" >&2
+    ;;
+  env)
+    echo "$TF_TEST_VALUE"
+    ;;
+  fail)
+    echo "Error: something went wrong" >&2
+    exit 3
+    ;;
+  hang)
+    while true; do echo tick >> ticks; sleep 0.1; done &
+    wait
+    ;;
+esac
+`
+	BeforeEach(func() {
+		dir, err = ioutil.TempDir("", "runner")
+		Expect(err).ToNot(HaveOccurred())
+		binary := filepath.Join(dir, "terraform")
+		Expect(ioutil.WriteFile(binary, []byte(script), 0700)).To(Succeed())
+		runner = &terraform.Runner{Binary: binary, Timeout: time.Minute}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("Should keep the output of concurrent runs separated", func() {
+		var wg sync.WaitGroup
+		results := make([]*terraform.Result, 10)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer GinkgoRecover()
+				res, err := runner.Run(context.Background(), terraform.Invocation{
+					Dir:  dir,
+					Args: []string{"echo", strconv.Itoa(i)},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				results[i] = res
+			}(i)
+		}
+		wg.Wait()
+		for i, res := range results {
+			Expect(res.Stdout).To(Equal(fmt.Sprintf("stdout %d\n", i)))
+			Expect(res.Stderr).To(Equal(fmt.Sprintf("stderr %d\n", i)))
+		}
+	})
+
+	It("Should pass the invocation environment to terraform only", func() {
+		res, err := runner.Run(context.Background(), terraform.Invocation{
+			Dir:  dir,
+			Env:  []string{"TF_TEST_VALUE=my-value"},
+			Args: []string{"env"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.Stdout).To(Equal("my-value\n"))
+		Expect(os.Getenv("TF_TEST_VALUE")).To(BeEmpty())
+	})
+
+	It("Should return the exit code and stderr on failure", func() {
+		res, err := runner.Run(context.Background(), terraform.Invocation{
+			Dir:  dir,
+			Args: []string{"fail"},
+		})
+		Expect(err).To(HaveOccurred())
+		tfErr, ok := err.(*terraform.Error)
+		Expect(ok).To(BeTrue())
+		Expect(tfErr.ExitCode).To(Equal(3))
+		Expect(tfErr.Stderr).To(ContainSubstring("something went wrong"))
+		Expect(res.ExitCode).To(Equal(3))
+	})
+
+	It("Should kill the whole process group once the timeout expires", func() {
+		start := time.Now()
+		_, err := runner.Run(context.Background(), terraform.Invocation{
+			Dir:     dir,
+			Timeout: 500 * time.Millisecond,
+			Args:    []string{"hang"},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("interrupted"))
+		Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+
+		ticks := func() int {
+			b, err := ioutil.ReadFile(filepath.Join(dir, "ticks"))
+			Expect(err).ToNot(HaveOccurred())
+			return len(b)
+		}
+		Consistently(ticks, time.Second, 200*time.Millisecond).Should(Equal(ticks()))
+	})
+
+	It("Should stop terraform when the context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(500*time.Millisecond, cancel)
+		_, err := runner.Run(ctx, terraform.Invocation{
+			Dir:  dir,
+			Args: []string{"hang"},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(context.Canceled.Error()))
+	})
+})
+
+var _ = Describe("Scrub", func() {
+	It("Should redact the environment of the run from its errors", func() {
+		executor := terraform.NewFakeExecutor().On("apply", terraform.FakeResponse{
+			Stderr:   `Error: password "jEnv2000!" rejected for user-1`,
+			ExitCode: 1,
+		})
+		err := terraform.Apply(context.Background(), executor, "instance", []string{"TF_VAR_user_0_password=jEnv2000!", "TF_VAR_empty="})
+		Expect(err).To(HaveOccurred())
+		tfErr, ok := err.(*terraform.Error)
+		Expect(ok).To(BeTrue())
+		Expect(tfErr.ExitCode).To(Equal(1))
+		Expect(tfErr.Error()).ToNot(ContainSubstring("jEnv2000!"))
+		Expect(tfErr.Error()).To(ContainSubstring(`password "` + terraform.Redacted + `" rejected for user-1`))
+	})
+})
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package terraform
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup start terraform in its own process group, so providers plugins
+// are signaled together with terraform
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func interruptProcessGroup(cmd *exec.Cmd) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
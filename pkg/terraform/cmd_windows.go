@@ -0,0 +1,15 @@
+package terraform
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func interruptProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
@@ -0,0 +1,124 @@
+package terraform
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FakeResponse is the canned outcome of a fake terraform run
+type FakeResponse struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// Err is returned as is when set, ExitCode is ignored
+	Err error
+}
+
+// FakeExecutor is a scriptable Executor which records every invocation instead of
+// running terraform, it is meant to be used by tests
+type FakeExecutor struct {
+	// OnRun is called for every invocation before the response is returned
+	OnRun func(inv Invocation)
+
+	mu          sync.Mutex
+	responses   map[string][]FakeResponse
+	invocations []Invocation
+}
+
+var _ Executor = &FakeExecutor{}
+
+// NewFakeExecutor return a FakeExecutor answering every command with success
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{
+		responses: make(map[string][]FakeResponse),
+	}
+}
+
+// On register responses for a terraform command, e.g. "apply". The command can be
+// prefixed by the base name of the working directory, e.g. "bucket/apply", to only
+// match runs in that directory. Responses replace the ones previously registered
+// for the command, they are consumed in order and the last one is kept for all
+// subsequent runs.
+func (f *FakeExecutor) On(command string, responses ...FakeResponse) *FakeExecutor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[command] = responses
+	return f
+}
+
+// Run implements Executor
+func (f *FakeExecutor) Run(ctx context.Context, inv Invocation) (*Result, error) {
+	f.mu.Lock()
+	f.invocations = append(f.invocations, inv)
+	resp := f.next(inv)
+	onRun := f.OnRun
+	f.mu.Unlock()
+
+	if onRun != nil {
+		onRun(inv)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	res := &Result{Stdout: resp.Stdout, Stderr: resp.Stderr, ExitCode: resp.ExitCode}
+	if resp.Err != nil {
+		return res, resp.Err
+	}
+	if resp.ExitCode != 0 {
+		return res, &Error{Command: strings.Join(inv.Args, " "), ExitCode: resp.ExitCode, Stderr: resp.Stderr}
+	}
+	if inv.Args[0] == "init" {
+		// Leave the working directory initialized, as terraform init does
+		_ = os.Mkdir(filepath.Join(inv.Dir, ".terraform"), 0700)
+	}
+	return res, nil
+}
+
+func (f *FakeExecutor) next(inv Invocation) FakeResponse {
+	if len(inv.Args) == 0 {
+		return FakeResponse{}
+	}
+	keys := []string{filepath.Base(inv.Dir) + "/" + inv.Args[0], inv.Args[0]}
+	for _, k := range keys {
+		queue, ok := f.responses[k]
+		if !ok || len(queue) == 0 {
+			continue
+		}
+		if len(queue) > 1 {
+			f.responses[k] = queue[1:]
+		}
+		return queue[0]
+	}
+	return FakeResponse{}
+}
+
+// Invocations return all recorded invocations
+func (f *FakeExecutor) Invocations() []Invocation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Invocation(nil), f.invocations...)
+}
+
+// Commands return the recorded invocations as "<dir base name>/<command>"
+func (f *FakeExecutor) Commands() []string {
+	var commands []string
+	for _, inv := range f.Invocations() {
+		if len(inv.Args) == 0 {
+			continue
+		}
+		commands = append(commands, filepath.Base(inv.Dir)+"/"+inv.Args[0])
+	}
+	return commands
+}
+
+// Reset forget all recorded invocations and registered responses
+func (f *FakeExecutor) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.invocations = nil
+	f.responses = make(map[string][]FakeResponse)
+}
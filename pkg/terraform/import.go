@@ -0,0 +1,94 @@
+package terraform
+
+import (
+	"context"
+	"strings"
+
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+)
+
+// Import is an existing cloud resource to bring under the terraform state
+type Import struct {
+	// Address of the resource in the rendered configuration
+	Address string
+	// ID of the cloud resource, in the provider import format
+	ID string
+}
+
+// InstanceImports return the resources of the instance module named in the spec, with the
+// addresses used by GenerateTFInstance
+func InstanceImports(instance *sqlv1alpha1.PostgreSql) []Import {
+	sql := instance.Spec.SqlInstance
+	imports := []Import{{
+		Address: instanceResourceName + ".instance",
+		ID:      sql.Project + "/" + sql.Name,
+	}}
+	var databases, users []Import
+	for i, k := range instance.Spec.Databases {
+		name := "database"
+		if i > 0 {
+			name = "additional_databases"
+		}
+		databases = appendImport(databases, Import{
+			Address: dataBaseResourceName + "." + name,
+			ID:      k.Project + "/" + k.Instance + "/" + k.Name,
+		})
+	}
+	for i, k := range instance.Spec.Users {
+		name := "default"
+		if i > 0 {
+			name = "additional_users"
+		}
+		users = appendImport(users, Import{
+			Address: userResourceName + "." + name,
+			ID:      k.Project + "/" + k.Instance + "/" + k.Name,
+		})
+	}
+	imports = append(imports, databases...)
+	return append(imports, users...)
+}
+
+// BucketImport return the state bucket of the instance, with the address used by GenerateBucketTF
+func BucketImport(instance *sqlv1alpha1.PostgreSql) Import {
+	bucket := instance.Spec.BucketConfig
+	return Import{
+		Address: bucketResourceName + ".bucket",
+		ID:      bucket.Project + "/" + bucket.Name,
+	}
+}
+
+// appendImport add an import, replacing the one with the same address as the rendered
+// configuration only keeps the last resource of an address
+func appendImport(imports []Import, imp Import) []Import {
+	for i := range imports {
+		if imports[i].Address == imp.Address {
+			imports[i] = imp
+			return imports
+		}
+	}
+	return append(imports, imp)
+}
+
+// StateList return the addresses of the resources in the state
+func StateList(ctx context.Context, e Executor, dir string, env []string) ([]string, error) {
+	out, err := terraform(ctx, e, dir, env, "state", "list")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// ImportResource import an existing cloud resource into the state
+func ImportResource(ctx context.Context, e Executor, dir string, env []string, imp Import) error {
+	_, err := terraform(ctx, e, dir, env, "import", "-input=false", imp.Address, imp.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// IsNotFoundImport return whether an import failed because the cloud resource does not exist
+func IsNotFoundImport(err error) bool {
+	tfErr, ok := err.(*Error)
+	return ok && strings.Contains(tfErr.Stderr, "Cannot import non-existent remote object")
+}
@@ -0,0 +1,56 @@
+package terraform_test
+
+import (
+	"context"
+	"fmt"
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Import", func() {
+	It("Should name the instance, databases and users of the spec", func() {
+		instance := &sqlv1alpha1.PostgreSql{
+			Spec: sqlv1alpha1.PostgreSqlSpec{
+				SqlInstance: sqlv1alpha1.PostgresqlInstanceSpec{Name: "my-instance", Project: "my-project"},
+				Databases: []sqlv1alpha1.PostgresInstanceDatabases{
+					{Project: "my-project", Instance: "my-instance", Name: "db"},
+					{Project: "my-project", Instance: "my-instance", Name: "reporting"},
+				},
+				Users: []sqlv1alpha1.PostgresInstanceDatabaseUsers{
+					{Project: "my-project", Instance: "my-instance", Name: "user-1"},
+				},
+			},
+		}
+		Expect(terraform.InstanceImports(instance)).To(Equal([]terraform.Import{
+			{Address: "google_sql_database_instance.instance", ID: "my-project/my-instance"},
+			{Address: "google_sql_database.database", ID: "my-project/my-instance/db"},
+			{Address: "google_sql_database.additional_databases", ID: "my-project/my-instance/reporting"},
+			{Address: "google_sql_user.default", ID: "my-project/my-instance/user-1"},
+		}))
+	})
+
+	It("Should list the resources of the state", func() {
+		executor := terraform.NewFakeExecutor().
+			On("state", terraform.FakeResponse{Stdout: "google_sql_database_instance.instance\ngoogle_sql_user.default\n"})
+		addresses, err := terraform.StateList(context.Background(), executor, "instance", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addresses).To(Equal([]string{"google_sql_database_instance.instance", "google_sql_user.default"}))
+		Expect(executor.Invocations()[0].Args).To(Equal([]string{"state", "list"}))
+	})
+
+	It("Should import a resource at its address", func() {
+		executor := terraform.NewFakeExecutor()
+		imp := terraform.Import{Address: "google_sql_database_instance.instance", ID: "my-project/my-instance"}
+		Expect(terraform.ImportResource(context.Background(), executor, "instance", nil, imp)).To(Succeed())
+		Expect(executor.Invocations()[0].Args).To(Equal([]string{"import", "-input=false", "google_sql_database_instance.instance", "my-project/my-instance"}))
+	})
+
+	It("Should recognize imports of missing resources", func() {
+		notFound := &terraform.Error{Command: "import", ExitCode: 1, Stderr: "Error: Cannot import non-existent remote object"}
+		Expect(terraform.IsNotFoundImport(notFound)).To(BeTrue())
+		Expect(terraform.IsNotFoundImport(&terraform.Error{Command: "import", ExitCode: 1, Stderr: "Error: googleapi: Error 403"})).To(BeFalse())
+		Expect(terraform.IsNotFoundImport(fmt.Errorf("Cannot import non-existent remote object"))).To(BeFalse())
+	})
+})
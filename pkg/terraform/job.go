@@ -0,0 +1,374 @@
+package terraform
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	kubeApiV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DefaultImage is the terraform image run by the Jobs
+	DefaultImage = "hashicorp/terraform:0.15.5"
+	// WorkspaceLabel is set on every terraform Job with the hash of its working directory
+	WorkspaceLabel = sqlv1alpha1.AnnotationPrefix + "workspace"
+
+	defaultPollInterval = 5 * time.Second
+	jobContainer        = "terraform"
+	workspaceVolume     = "workspace"
+	// jobScript runs terraform, keeps a copy of its stdout in the workspace and exits with its exit code.
+	// The copy may hold the values of the variables, it is only readable by the user of the Job
+	jobScript = `umask 077; { terraform "$@"; echo $? > "$TF_EXIT_FILE"; } | tee "$TF_STDOUT_FILE"; exit "$(cat "$TF_EXIT_FILE")"`
+	// deleteTimeout bounds the deletion of the Job of an interrupted run, a later run finishes it
+	deleteTimeout = time.Minute
+)
+
+// JobLogs return the logs of the pod of a terraform Job
+type JobLogs func(ctx context.Context, namespace, job string) (string, error)
+
+// ClientsetJobLogs return JobLogs reading the pod logs through the clientset
+func ClientsetJobLogs(clientset kubernetes.Interface) JobLogs {
+	return func(ctx context.Context, namespace, job string) (string, error) {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + job})
+		if err != nil {
+			return "", err
+		}
+		if len(pods.Items) == 0 {
+			return "", fmt.Errorf("no pod found for job %s/%s", namespace, job)
+		}
+		logs, err := clientset.CoreV1().Pods(namespace).GetLogs(pods.Items[0].Name, &kubeApiV1.PodLogOptions{Container: jobContainer}).DoRaw(ctx)
+		if err != nil {
+			return "", err
+		}
+		return string(logs), nil
+	}
+}
+
+// JobExecutor runs every terraform command as a Kubernetes Job, out of the manager pod. The
+// workspaces must be stored on VolumeClaim, mounted at WorkspaceRoot in both the manager and the Jobs.
+type JobExecutor struct {
+	// Client manages the Jobs and their Secrets
+	Client client.Client
+	// Logs reads the logs of the Job pods, e.g. ClientsetJobLogs
+	Logs JobLogs
+	Log  logr.Logger
+	// Namespace where the Jobs are created, it must hold VolumeClaim
+	Namespace string
+	// Image is the terraform image, DefaultImage when empty
+	Image string
+	// ServiceAccount runs the Jobs, its ambient credentials are used by the PostgreSqls authenticated with
+	// WorkloadIdentity. The default service account of Namespace runs them when empty
+	ServiceAccount string
+	// VolumeClaim is the ReadWriteMany PersistentVolumeClaim holding the workspaces
+	VolumeClaim string
+	// WorkspaceRoot is the directory where VolumeClaim is mounted
+	WorkspaceRoot string
+	// User and Group run the Jobs and own VolumeClaim, they must be the ones of the manager
+	// since the workspaces are only reachable by their owner
+	User  int64
+	Group int64
+	// Timeout is used when the invocation has none
+	Timeout time.Duration
+	// PollInterval is the period between two checks of the Job status
+	PollInterval time.Duration
+}
+
+var _ Executor = &JobExecutor{}
+
+// JobName return the deterministic name of the Job running an invocation, a manager
+// restarting during a run attaches to the Job started before the restart
+func JobName(inv Invocation) string {
+	sum := sha256.Sum256([]byte(inv.Dir + "\x00" + strings.Join(inv.Args, "\x00")))
+	command := "run"
+	if len(inv.Args) > 0 {
+		command = inv.Args[0]
+	}
+	return fmt.Sprintf("terraform-%s-%s", command, hex.EncodeToString(sum[:])[:16])
+}
+
+// Run implements Executor
+func (j *JobExecutor) Run(ctx context.Context, inv Invocation) (*Result, error) {
+	timeout := inv.Timeout
+	if timeout == 0 {
+		timeout = j.Timeout
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	command := strings.Join(inv.Args, " ")
+	name := JobName(inv)
+	log := j.Log.WithValues("job", types.NamespacedName{Namespace: j.Namespace, Name: name}, "command", command)
+
+	if err := j.startJob(ctx, name, inv, timeout); err != nil {
+		return nil, fmt.Errorf("failed to start terraform %s job: %v", command, err)
+	}
+	log.Info("terraform job started")
+	if err := j.waitJob(ctx, name); err != nil {
+		// Deleting the Job terminates terraform
+		deleteCtx, cancelDelete := context.WithTimeout(context.Background(), deleteTimeout)
+		defer cancelDelete()
+		if errD := j.deleteJob(deleteCtx, name); errD != nil {
+			log.Error(errD, "failed to delete terraform job")
+		}
+		wipeOutput(inv.Dir, name)
+		return nil, fmt.Errorf("terraform %s interrupted: %v", command, err)
+	}
+
+	res := j.collect(ctx, name, inv)
+	log.Info("terraform job finished", "exitCode", res.ExitCode)
+	if err := j.deleteJob(ctx, name); err != nil {
+		log.Error(err, "failed to delete terraform job")
+	}
+	if res.ExitCode != 0 {
+		return res, &Error{Command: command, ExitCode: res.ExitCode, Stderr: res.Stderr}
+	}
+	return res, nil
+}
+
+// startJob create the Job of the invocation, unless it is still running from a previous attempt
+func (j *JobExecutor) startJob(ctx context.Context, name string, inv Invocation, timeout time.Duration) error {
+	if !strings.HasPrefix(filepath.Clean(inv.Dir), filepath.Clean(j.WorkspaceRoot)+string(filepath.Separator)) {
+		return fmt.Errorf("workspace %s is not under %s", inv.Dir, j.WorkspaceRoot)
+	}
+	existing := &batchv1.Job{}
+	err := j.Client.Get(ctx, types.NamespacedName{Namespace: j.Namespace, Name: name}, existing)
+	switch {
+	case err == nil && existing.DeletionTimestamp == nil && !isJobFinished(existing):
+		return nil
+	case err == nil:
+		// A finished Job holds the result of a previous run, and a Job being deleted belongs to an interrupted one
+		if err := j.deleteJob(ctx, name); err != nil {
+			return err
+		}
+	case !errors.IsNotFound(err):
+		return err
+	}
+	wipeOutput(inv.Dir, name)
+
+	job := j.newJob(name, inv, timeout)
+	if len(inv.Env) == 0 {
+		return j.Client.Create(ctx, job)
+	}
+	// The environment may hold credentials, it is passed through a Secret created before the Job,
+	// so that its pod never starts without it, and then owned by the Job
+	secret := &kubeApiV1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: j.Namespace,
+			Labels:    job.Labels,
+		},
+		StringData: make(map[string]string),
+	}
+	for _, kv := range inv.Env {
+		if i := strings.Index(kv, "="); i > 0 {
+			secret.StringData[kv[:i]] = kv[i+1:]
+		}
+	}
+	err = j.Client.Create(ctx, secret)
+	if errors.IsAlreadyExists(err) {
+		// Left by a previous attempt which failed to create its Job
+		existing := &kubeApiV1.Secret{}
+		if err := j.Client.Get(ctx, types.NamespacedName{Namespace: j.Namespace, Name: name}, existing); err != nil {
+			return err
+		}
+		existing.Labels = secret.Labels
+		existing.Data = nil
+		existing.StringData = secret.StringData
+		secret = existing
+		err = j.Client.Update(ctx, secret)
+	}
+	if err != nil {
+		return err
+	}
+	if err := j.Client.Create(ctx, job); err != nil {
+		return err
+	}
+	secret.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Name:       job.Name,
+		UID:        job.UID,
+	}}
+	return j.Client.Update(ctx, secret)
+}
+
+func (j *JobExecutor) newJob(name string, inv Invocation, timeout time.Duration) *batchv1.Job {
+	image := j.Image
+	if image == "" {
+		image = DefaultImage
+	}
+	sum := sha256.Sum256([]byte(inv.Dir))
+	labels := map[string]string{
+		"app.kubernetes.io/managed-by": "terrak8s",
+		WorkspaceLabel:                 hex.EncodeToString(sum[:])[:16],
+	}
+	backoffLimit := int32(0)
+	user, group := j.User, j.Group
+	deadline := int64(timeout.Seconds())
+	container := kubeApiV1.Container{
+		Name:       jobContainer,
+		Image:      image,
+		Command:    []string{"/bin/sh", "-c", jobScript, "terraform"},
+		Args:       inv.Args,
+		WorkingDir: inv.Dir,
+		Env: []kubeApiV1.EnvVar{
+			{Name: "TF_IN_AUTOMATION", Value: "true"},
+			{Name: "KUBE_IN_CLUSTER_CONFIG", Value: "true"},
+			{Name: "TF_STDOUT_FILE", Value: stdoutFile(inv.Dir, name)},
+			{Name: "TF_EXIT_FILE", Value: exitFile(inv.Dir, name)},
+		},
+		VolumeMounts: []kubeApiV1.VolumeMount{{Name: workspaceVolume, MountPath: j.WorkspaceRoot}},
+	}
+	if len(inv.Env) > 0 {
+		container.EnvFrom = []kubeApiV1.EnvFromSource{{
+			SecretRef: &kubeApiV1.SecretEnvSource{LocalObjectReference: kubeApiV1.LocalObjectReference{Name: name}},
+		}}
+	}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: j.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: &deadline,
+			Template: kubeApiV1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: kubeApiV1.PodSpec{
+					RestartPolicy:      kubeApiV1.RestartPolicyNever,
+					ServiceAccountName: j.ServiceAccount,
+					SecurityContext: &kubeApiV1.PodSecurityContext{
+						RunAsUser:  &user,
+						RunAsGroup: &group,
+						FSGroup:    &group,
+					},
+					Containers: []kubeApiV1.Container{container},
+					Volumes: []kubeApiV1.Volume{{
+						Name: workspaceVolume,
+						VolumeSource: kubeApiV1.VolumeSource{
+							PersistentVolumeClaim: &kubeApiV1.PersistentVolumeClaimVolumeSource{ClaimName: j.VolumeClaim},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// waitJob poll the Job until it is finished or ctx is done
+func (j *JobExecutor) waitJob(ctx context.Context, name string) error {
+	interval := j.PollInterval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job := &batchv1.Job{}
+		if err := j.Client.Get(ctx, types.NamespacedName{Namespace: j.Namespace, Name: name}, job); err != nil {
+			return err
+		}
+		if isJobFinished(job) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect read the result of a finished Job, the exit code is -1 when terraform did not complete
+func (j *JobExecutor) collect(ctx context.Context, name string, inv Invocation) *Result {
+	res := &Result{ExitCode: -1}
+	if b, err := ioutil.ReadFile(exitFile(inv.Dir, name)); err == nil {
+		if code, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			res.ExitCode = code
+		}
+	}
+	if b, err := ioutil.ReadFile(stdoutFile(inv.Dir, name)); err == nil {
+		res.Stdout = string(b)
+	}
+	wipeOutput(inv.Dir, name)
+
+	// The pod logs hold both stdout and stderr
+	logs, err := j.Logs(ctx, j.Namespace, name)
+	if err != nil {
+		j.Log.Error(err, "failed to read terraform job logs", "job", name)
+		return res
+	}
+	res.Stderr = logs
+	return res
+}
+
+// deleteJob delete the Job with its pods and Secret, and wait until it is gone
+func (j *JobExecutor) deleteJob(ctx context.Context, name string) error {
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: j.Namespace}}
+	err := j.Client.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	interval := j.PollInterval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	for {
+		err := j.Client.Get(ctx, types.NamespacedName{Namespace: j.Namespace, Name: name}, &batchv1.Job{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func isJobFinished(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == kubeApiV1.ConditionTrue {
+			return true
+		}
+	}
+	return job.Status.Succeeded > 0 || job.Status.Failed > 0
+}
+
+// wipeOutput remove the copy of the stdout of a Job and its exit code from the workspace, the stdout of
+// terraform show -json holds the values of the variables
+func wipeOutput(dir, name string) {
+	_ = os.Remove(stdoutFile(dir, name))
+	_ = os.Remove(exitFile(dir, name))
+}
+
+func stdoutFile(dir, name string) string {
+	return filepath.Join(dir, "."+name+".stdout")
+}
+
+func exitFile(dir, name string) string {
+	return filepath.Join(dir, "."+name+".exit")
+}
@@ -0,0 +1,210 @@
+package terraform_test
+
+import (
+	"context"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	batchv1 "k8s.io/api/batch/v1"
+	kubeApiV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"time"
+)
+
+var _ = Describe("JobExecutor", func() {
+	var (
+		root      string
+		dir       string
+		k8sClient client.Client
+		logs      map[string]string
+		executor  *terraform.JobExecutor
+		inv       terraform.Invocation
+		err       error
+	)
+
+	BeforeEach(func() {
+		root, err = ioutil.TempDir("", "workspaces")
+		Expect(err).ToNot(HaveOccurred())
+		dir = filepath.Join(root, "demo_my-instance", "instance")
+		Expect(os.MkdirAll(dir, 0700)).To(Succeed())
+
+		k8sClient = fake.NewFakeClientWithScheme(clientgoscheme.Scheme)
+		logs = make(map[string]string)
+		executor = &terraform.JobExecutor{
+			Client: k8sClient,
+			Logs: func(ctx context.Context, namespace, job string) (string, error) {
+				return logs[namespace+"/"+job], nil
+			},
+			Log:            logf.Log.WithName("job"),
+			Namespace:      "terrak8s-operator",
+			ServiceAccount: "sa-terrak8s-controller",
+			VolumeClaim:    "workspaces",
+			WorkspaceRoot:  root,
+			User:           65532,
+			Group:          65532,
+			PollInterval:   10 * time.Millisecond,
+		}
+		inv = terraform.Invocation{
+			Dir:  dir,
+			Env:  []string{`GOOGLE_CREDENTIALS={"type": "service_account"}`},
+			Args: []string{"output", "-json"},
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	getJob := func() (*batchv1.Job, error) {
+		job := &batchv1.Job{}
+		key := types.NamespacedName{Namespace: executor.Namespace, Name: terraform.JobName(inv)}
+		return job, k8sClient.Get(context.Background(), key, job)
+	}
+
+	// finish simulates the terraform Job once it has been created
+	finish := func(exitCode string, stdout string, succeeded bool) {
+		go func() {
+			defer GinkgoRecover()
+			var job *batchv1.Job
+			Eventually(func() error {
+				var errG error
+				job, errG = getJob()
+				return errG
+			}).Should(Succeed())
+			name := terraform.JobName(inv)
+			Expect(ioutil.WriteFile(filepath.Join(dir, "."+name+".stdout"), []byte(stdout), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "."+name+".exit"), []byte(exitCode+"\n"), 0600)).To(Succeed())
+			logs[executor.Namespace+"/"+name] = "Outputs:\n" + stdout
+			if succeeded {
+				job.Status.Succeeded = 1
+			} else {
+				job.Status.Failed = 1
+			}
+			Expect(k8sClient.Status().Update(context.Background(), job)).To(Succeed())
+		}()
+	}
+
+	It("Should name Jobs after their invocation", func() {
+		other := inv
+		other.Args = []string{"apply", "-input=false"}
+		Expect(terraform.JobName(inv)).To(Equal(terraform.JobName(inv)))
+		Expect(terraform.JobName(inv)).To(HavePrefix("terraform-output-"))
+		Expect(terraform.JobName(inv)).ToNot(Equal(terraform.JobName(other)))
+		Expect(len(terraform.JobName(inv))).To(BeNumerically("<=", 63))
+	})
+
+	It("Should run terraform in a Job mounting the workspace and the environment Secret", func() {
+		var job *batchv1.Job
+		go func() {
+			defer GinkgoRecover()
+			Eventually(func() error {
+				var errG error
+				job, errG = getJob()
+				return errG
+			}).Should(Succeed())
+		}()
+		finish("0", `{"connectionName": {"value": "my-connection"}}`, true)
+
+		res, err := executor.Run(context.Background(), inv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.ExitCode).To(BeZero())
+		Expect(res.Stdout).To(Equal(`{"connectionName": {"value": "my-connection"}}`))
+		Expect(res.Stderr).To(ContainSubstring("Outputs:"))
+
+		container := job.Spec.Template.Spec.Containers[0]
+		Expect(container.Image).To(Equal(terraform.DefaultImage))
+		Expect(container.Args).To(Equal(inv.Args))
+		Expect(container.WorkingDir).To(Equal(dir))
+		Expect(container.VolumeMounts[0].MountPath).To(Equal(root))
+		Expect(job.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("workspaces"))
+		Expect(job.Spec.Template.Spec.ServiceAccountName).To(Equal("sa-terrak8s-controller"))
+		securityContext := job.Spec.Template.Spec.SecurityContext
+		Expect(*securityContext.RunAsUser).To(BeEquivalentTo(65532))
+		Expect(*securityContext.RunAsGroup).To(BeEquivalentTo(65532))
+		Expect(*securityContext.FSGroup).To(BeEquivalentTo(65532))
+		Expect(container.EnvFrom[0].SecretRef.Name).To(Equal(job.Name))
+		for _, env := range container.Env {
+			Expect(env.Name).ToNot(Equal("GOOGLE_CREDENTIALS"))
+		}
+
+		secret := &kubeApiV1.Secret{}
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Namespace: executor.Namespace, Name: job.Name}, secret)).To(Succeed())
+		Expect(secret.StringData).To(HaveKeyWithValue("GOOGLE_CREDENTIALS", `{"type": "service_account"}`))
+		Expect(secret.OwnerReferences[0].Name).To(Equal(job.Name))
+
+		By("deleting the finished Job")
+		_, err = getJob()
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("Should replace the environment Secret left by a previous attempt", func() {
+		leftover := &kubeApiV1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: terraform.JobName(inv), Namespace: executor.Namespace},
+			StringData: map[string]string{"GOOGLE_CREDENTIALS": "expired"},
+		}
+		Expect(k8sClient.Create(context.Background(), leftover)).To(Succeed())
+		finish("0", "{}", true)
+
+		_, err := executor.Run(context.Background(), inv)
+		Expect(err).ToNot(HaveOccurred())
+		secret := &kubeApiV1.Secret{}
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Namespace: executor.Namespace, Name: leftover.Name}, secret)).To(Succeed())
+		Expect(secret.StringData).To(HaveKeyWithValue("GOOGLE_CREDENTIALS", `{"type": "service_account"}`))
+		Expect(secret.OwnerReferences[0].Name).To(Equal(leftover.Name))
+	})
+
+	It("Should attach to a Job still running from a previous attempt", func() {
+		running := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: terraform.JobName(inv), Namespace: executor.Namespace}}
+		Expect(k8sClient.Create(context.Background(), running)).To(Succeed())
+		finish("0", "{}", true)
+
+		res, err := executor.Run(context.Background(), inv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.Stdout).To(Equal("{}"))
+	})
+
+	It("Should return the terraform exit code of a failed Job", func() {
+		finish("1", "", false)
+
+		res, err := executor.Run(context.Background(), inv)
+		Expect(err).To(HaveOccurred())
+		tfErr, ok := err.(*terraform.Error)
+		Expect(ok).To(BeTrue())
+		Expect(tfErr.ExitCode).To(Equal(1))
+		Expect(res.ExitCode).To(Equal(1))
+	})
+
+	It("Should delete the Job once the timeout expires", func() {
+		inv.Timeout = 100 * time.Millisecond
+
+		_, err := executor.Run(context.Background(), inv)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("interrupted"))
+		_, err = getJob()
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("Should not leave the stdout of a Job in the workspace", func() {
+		finish("0", `{"variables": {"password": {"value": "secret"}}}`, true)
+
+		_, err := executor.Run(context.Background(), inv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Join(dir, "."+terraform.JobName(inv)+".stdout")).ToNot(BeAnExistingFile())
+	})
+
+	It("Should refuse workspaces which are not on the volume claim", func() {
+		inv.Dir = os.TempDir()
+
+		_, err := executor.Run(context.Background(), inv)
+		Expect(err).To(MatchError(ContainSubstring("is not under")))
+	})
+})
@@ -0,0 +1,77 @@
+package terraform
+
+import (
+	"bufio"
+	"context"
+	"strings"
+)
+
+// LockInfo describes the terraform state lock held by another run
+type LockInfo struct {
+	ID        string
+	Path      string
+	Operation string
+	Who       string
+	Version   string
+	Created   string
+}
+
+// httpLockedPrefix precedes the lock ID in the errors of the http backend, which does not
+// report the other fields of the lock
+const httpLockedPrefix = "HTTP remote state already locked: ID="
+
+// ParseLockError return the lock info of an error caused by a held state lock
+func ParseLockError(err error) (*LockInfo, bool) {
+	tfErr, ok := err.(*Error)
+	if !ok || !strings.Contains(tfErr.Stderr, "Error acquiring the state lock") {
+		return nil, false
+	}
+	if i := strings.Index(tfErr.Stderr, httpLockedPrefix); i >= 0 {
+		id := strings.Fields(tfErr.Stderr[i+len(httpLockedPrefix):])
+		if len(id) == 0 {
+			return nil, false
+		}
+		return &LockInfo{ID: id[0]}, true
+	}
+	lock := &LockInfo{}
+	fields := map[string]*string{
+		"ID":        &lock.ID,
+		"Path":      &lock.Path,
+		"Operation": &lock.Operation,
+		"Who":       &lock.Who,
+		"Version":   &lock.Version,
+		"Created":   &lock.Created,
+	}
+	inLockInfo := false
+	scanner := bufio.NewScanner(strings.NewReader(tfErr.Stderr))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "Lock Info:" {
+			inLockInfo = true
+			continue
+		}
+		if !inLockInfo {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			break
+		}
+		if field, ok := fields[line[:i]]; ok {
+			*field = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if lock.ID == "" {
+		return nil, false
+	}
+	return lock, true
+}
+
+// ForceUnlock remove the state lock with the given ID
+func ForceUnlock(ctx context.Context, e Executor, dir string, env []string, id string) error {
+	_, err := terraform(ctx, e, dir, env, "force-unlock", "-force", id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package terraform_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const lockError = `
+Error: Error locking state: Error acquiring the state lock: writing "gs://my-bucket/dev/tfstate/default.tflock" failed: googleapi: Error 412: Precondition Failed, conditionNotMet
+Lock Info:
+  ID:        1614691153284474
+  Path:      gs://my-bucket/dev/tfstate/default.tflock
+  Operation: OperationTypeApply
+  Who:       nonroot@terrak8s-controller-5d8f7b9c4-x2x7k
+  Version:   0.13.5
+  Created:   2021-03-02 13:19:13.140146 +0000 UTC
+  Info:
+
+Terraform acquires a state lock to protect the state from being written
+by multiple users at the same time. Please resolve the issue above and try
+again. For most commands, you can disable locking with the "-lock=false"
+flag, but this is not recommended.
+`
+
+var _ = Describe("Lock", func() {
+	It("Should parse the lock info of a state lock error", func() {
+		lock, ok := terraform.ParseLockError(&terraform.Error{Command: "apply", ExitCode: 1, Stderr: lockError})
+		Expect(ok).To(BeTrue())
+		Expect(lock).To(Equal(&terraform.LockInfo{
+			ID:        "1614691153284474",
+			Path:      "gs://my-bucket/dev/tfstate/default.tflock",
+			Operation: "OperationTypeApply",
+			Who:       "nonroot@terrak8s-controller-5d8f7b9c4-x2x7k",
+			Version:   "0.13.5",
+			Created:   "2021-03-02 13:19:13.140146 +0000 UTC",
+		}))
+	})
+
+	It("Should parse the lock ID of an http backend lock error", func() {
+		stderr := "Error: Error locking state: Error acquiring the state lock: HTTP remote state already locked: ID=9db59ba3-8ea3-2d81-7d40-7e1d2e2e7c55\n"
+		lock, ok := terraform.ParseLockError(&terraform.Error{Command: "plan", ExitCode: 1, Stderr: stderr})
+		Expect(ok).To(BeTrue())
+		Expect(lock).To(Equal(&terraform.LockInfo{ID: "9db59ba3-8ea3-2d81-7d40-7e1d2e2e7c55"}))
+	})
+
+	It("Should ignore other errors", func() {
+		_, ok := terraform.ParseLockError(&terraform.Error{Command: "apply", ExitCode: 1, Stderr: "Error: googleapi: Error 400"})
+		Expect(ok).To(BeFalse())
+		_, ok = terraform.ParseLockError(fmt.Errorf("Error acquiring the state lock"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Should force-unlock the given lock", func() {
+		executor := terraform.NewFakeExecutor()
+		Expect(terraform.ForceUnlock(context.Background(), executor, "instance", nil, "1614691153284474")).To(Succeed())
+		Expect(executor.Invocations()[0].Args).To(Equal([]string{"force-unlock", "-force", "1614691153284474"}))
+	})
+})
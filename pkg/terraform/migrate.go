@@ -0,0 +1,105 @@
+package terraform
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/HamzaZo/terrak8s-operator/pkg/util"
+)
+
+// StateSummary is what a state migration must preserve
+type StateSummary struct {
+	Lineage string
+	Serial  int64
+	// Resources is the number of managed resource instances
+	Resources int
+}
+
+// String implements fmt.Stringer
+func (s StateSummary) String() string {
+	return fmt.Sprintf("%d resources at serial %d", s.Resources, s.Serial)
+}
+
+type stateJSON struct {
+	Lineage   string `json:"lineage"`
+	Serial    int64  `json:"serial"`
+	Resources []struct {
+		Mode      string            `json:"mode"`
+		Instances []json.RawMessage `json:"instances"`
+	} `json:"resources"`
+}
+
+// SummarizeState summarize the output of terraform state pull, an empty output is an empty state
+func SummarizeState(b []byte) (*StateSummary, error) {
+	summary := &StateSummary{}
+	if len(b) == 0 {
+		return summary, nil
+	}
+	state := stateJSON{}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode terraform state %v", err)
+	}
+	summary.Lineage = state.Lineage
+	summary.Serial = state.Serial
+	for _, r := range state.Resources {
+		if r.Mode == "managed" {
+			summary.Resources += len(r.Instances)
+		}
+	}
+	return summary, nil
+}
+
+// InitializedBackend is the backend a module was last initialized with, as recorded by terraform init
+type InitializedBackend struct {
+	Type   string                 `json:"type"`
+	Config map[string]interface{} `json:"config"`
+}
+
+// ReadInitializedBackend return the backend the module in dir was last initialized with, nil when the
+// module is not initialized
+func ReadInitializedBackend(dir string) (*InitializedBackend, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, ".terraform", "terraform.tfstate"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := struct {
+		Backend *InitializedBackend `json:"backend"`
+	}{}
+	if err = json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode the backend of %s %v", dir, err)
+	}
+	if state.Backend == nil || state.Backend.Type == "" {
+		return nil, nil
+	}
+	return state.Backend, nil
+}
+
+// GenerateInitializedBackendTF render the backend a module was initialized with in dir
+func GenerateInitializedBackendTF(backend *InitializedBackend, dir string) error {
+	config := make(map[string]interface{})
+	for k, v := range backend.Config {
+		// terraform records the unset arguments as null
+		if v != nil {
+			config[k] = v
+		}
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"terraform": map[string]interface{}{
+			"backend": map[string]interface{}{backend.Type: config},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	output, err := util.GetPrettyJSON(b)
+	if err != nil {
+		return err
+	}
+	return util.WriteToFile(output, dir, "backend.tf.json")
+}
@@ -0,0 +1,74 @@
+package terraform_test
+
+import (
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Migrate", func() {
+	It("Should count the managed resource instances of a state", func() {
+		summary, err := terraform.SummarizeState([]byte(`{
+  "version": 4, "lineage": "3b7e0f4c", "serial": 7,
+  "resources": [
+    {"mode": "managed", "type": "google_sql_database_instance", "instances": [{}]},
+    {"mode": "managed", "type": "google_sql_user", "instances": [{}, {}]},
+    {"mode": "data", "type": "google_project", "instances": [{}]}
+  ]
+}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*summary).To(Equal(terraform.StateSummary{Lineage: "3b7e0f4c", Serial: 7, Resources: 3}))
+
+		summary, err = terraform.SummarizeState(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*summary).To(BeZero())
+	})
+
+	It("Should render the backend a module was initialized with", func() {
+		dir, err := ioutil.TempDir("", "migrate")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		backend, err := terraform.ReadInitializedBackend(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend).To(BeNil())
+
+		Expect(os.Mkdir(filepath.Join(dir, ".terraform"), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, ".terraform", "terraform.tfstate"), []byte(`{
+  "version": 3,
+  "backend": {"type": "gcs", "config": {"bucket": "my-bucket", "prefix": "test/tfstate", "credentials": null}, "hash": 1234}
+}`), 0600)).To(Succeed())
+		backend, err = terraform.ReadInitializedBackend(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.Type).To(Equal("gcs"))
+
+		Expect(terraform.GenerateInitializedBackendTF(backend, dir)).To(Succeed())
+		b, err := ioutil.ReadFile(filepath.Join(dir, "backend.tf.json"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b).To(MatchJSON(`{"terraform": {"backend": {"gcs": {"bucket": "my-bucket", "prefix": "test/tfstate"}}}}`))
+	})
+
+	It("Should locate the state of every backend", func() {
+		instance := &sqlv1alpha1.PostgreSql{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-instance", Namespace: "demo"},
+			Spec: sqlv1alpha1.PostgreSqlSpec{
+				RemoteState: sqlv1alpha1.PostgresqlInstanceBackend{BucketName: "my-bucket", BucketPrefix: "demo/tfstate"},
+			},
+		}
+		locations := map[sqlv1alpha1.BackendType]string{
+			sqlv1alpha1.BackendGCS:        "gs://my-bucket/demo/tfstate",
+			sqlv1alpha1.BackendKubernetes: "kubernetes://demo/tfstate-default-postgresql-my-instance",
+			sqlv1alpha1.BackendHTTP:       "http://demo/my-instance",
+			sqlv1alpha1.BackendS3:         "http://127.0.0.1:9000/tfstate/demo/my-instance/terraform.tfstate",
+		}
+		instance.Spec.RemoteState.S3 = &sqlv1alpha1.PostgresqlInstanceS3Backend{Endpoint: "http://127.0.0.1:9000/", Bucket: "tfstate"}
+		for backendType, location := range locations {
+			instance.Spec.RemoteState.Type = backendType
+			Expect(terraform.StateLocation(instance)).To(Equal(location))
+		}
+	})
+})
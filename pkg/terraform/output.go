@@ -0,0 +1,86 @@
+package terraform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+)
+
+// InstanceOutput is a terraform output declared by the instance configuration
+type InstanceOutput struct {
+	// Name of the terraform output
+	Name string
+	// Value is the terraform expression of the output
+	Value string
+	// set stores the decoded value in the PostgreSql status
+	set func(out *sqlv1alpha1.PostgresInstanceOutput, value string)
+}
+
+// InstanceOutputs holds every output rendered in output.tf, and decoded from terraform output
+var InstanceOutputs = []InstanceOutput{
+	{
+		Name:  "connectionName",
+		Value: instanceResourceName + ".instance.connection_name",
+		set:   func(out *sqlv1alpha1.PostgresInstanceOutput, value string) { out.ConnectionName = value },
+	},
+	{
+		Name:  "connectionIPAddress",
+		Value: instanceResourceName + ".instance.private_ip_address",
+		set:   func(out *sqlv1alpha1.PostgresInstanceOutput, value string) { out.ConnectionIPAddress = value },
+	},
+}
+
+type outputJSON struct {
+	Sensitive bool            `json:"sensitive"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// DecodeOutput decode the output of terraform output -json, every declared output must
+// be present, not sensitive and hold a string
+func DecodeOutput(b []byte) (*sqlv1alpha1.PostgresInstanceOutput, error) {
+	var raw map[string]outputJSON
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode terraform output %v", err)
+	}
+	declared := make(map[string]bool, len(InstanceOutputs))
+	out := &sqlv1alpha1.PostgresInstanceOutput{}
+	for _, o := range InstanceOutputs {
+		declared[o.Name] = true
+		v, ok := raw[o.Name]
+		if !ok {
+			return nil, fmt.Errorf("terraform output %q is missing", o.Name)
+		}
+		if v.Sensitive {
+			return nil, fmt.Errorf("terraform output %q is sensitive and cannot be stored in the status", o.Name)
+		}
+		var value string
+		if err := json.Unmarshal(v.Value, &value); err != nil {
+			return nil, fmt.Errorf("terraform output %q is not a string: %s", o.Name, v.Value)
+		}
+		o.set(out, value)
+	}
+	var unknown []string
+	for name := range raw {
+		if !declared[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown terraform outputs %v", strings.Join(unknown, ", "))
+	}
+	return out, nil
+}
+
+// Output run terraform output -json and decode the instance outputs
+func Output(ctx context.Context, e Executor, dir string, env []string) (*sqlv1alpha1.PostgresInstanceOutput, error) {
+	out, err := terraform(ctx, e, dir, env, "output", "-json")
+	if err != nil {
+		return nil, err
+	}
+	return DecodeOutput([]byte(out))
+}
@@ -0,0 +1,61 @@
+package terraform_test
+
+import (
+	"context"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Output", func() {
+	It("Should decode every declared output", func() {
+		out, err := terraform.DecodeOutput([]byte(`{
+  "connectionIPAddress": {"sensitive": false, "type": "string", "value": "10.0.0.3"},
+  "connectionName": {"sensitive": false, "type": "string", "value": "my-project:region-1:my-instance"}
+}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out.ConnectionIPAddress).To(Equal("10.0.0.3"))
+		Expect(out.ConnectionName).To(Equal("my-project:region-1:my-instance"))
+	})
+
+	It("Should render every declared output", func() {
+		rendered := string(terraform.RenderInstanceOutput())
+		for _, o := range terraform.InstanceOutputs {
+			Expect(rendered).To(ContainSubstring(`output "` + o.Name + `" { value = ` + o.Value + ` }`))
+		}
+	})
+
+	It("Should fail on a missing output", func() {
+		_, err := terraform.DecodeOutput([]byte(`{
+  "connectionName": {"sensitive": false, "type": "string", "value": "my-project:region-1:my-instance"}
+}`))
+		Expect(err).To(MatchError(`terraform output "connectionIPAddress" is missing`))
+	})
+
+	It("Should fail on a sensitive output", func() {
+		_, err := terraform.DecodeOutput([]byte(`{
+  "connectionIPAddress": {"sensitive": true, "type": "string", "value": "10.0.0.3"},
+  "connectionName": {"sensitive": false, "type": "string", "value": "my-project:region-1:my-instance"}
+}`))
+		Expect(err).To(MatchError(ContainSubstring(`"connectionIPAddress" is sensitive`)))
+	})
+
+	It("Should fail on an unknown output", func() {
+		_, err := terraform.DecodeOutput([]byte(`{
+  "connectionIPAddress": {"sensitive": false, "type": "string", "value": "10.0.0.3"},
+  "connectionName": {"sensitive": false, "type": "string", "value": "my-project:region-1:my-instance"},
+  "publicIPAddress": {"sensitive": false, "type": "string", "value": "34.0.0.1"}
+}`))
+		Expect(err).To(MatchError("unknown terraform outputs publicIPAddress"))
+	})
+
+	It("Should only decode the output stream of terraform", func() {
+		executor := terraform.NewFakeExecutor().On("output", terraform.FakeResponse{
+			Stdout: `{"connectionIPAddress": {"value": "10.0.0.3"}, "connectionName": {"value": "my-connection"}}`,
+			Stderr: "Initializing the backend...",
+		})
+		out, err := terraform.Output(context.Background(), executor, "instance", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out.ConnectionName).To(Equal("my-connection"))
+	})
+})
@@ -0,0 +1,202 @@
+package terraform
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+const (
+	// PlanFile is the name of the saved plan inside a workspace
+	PlanFile = "tfplan"
+)
+
+// Plan summarize the changes of a saved terraform plan
+type Plan struct {
+	Add     int
+	Change  int
+	Destroy int
+	// Resources holds the addresses of the resources affected by the plan
+	Resources []string
+	// Hash identifies the planned changes, two plans with the same changes have the same hash
+	Hash string
+	// Attributes holds the updated attributes as "<resource address>.<attribute>"
+	Attributes []string
+}
+
+// HasChanges return whether applying the plan would change anything
+func (p *Plan) HasChanges() bool {
+	return p.Add+p.Change+p.Destroy > 0
+}
+
+// IsDestructive return whether applying the plan would destroy or replace resources
+func (p *Plan) IsDestructive() bool {
+	return p.Destroy > 0
+}
+
+func (p *Plan) String() string {
+	return fmt.Sprintf("%d to add, %d to change, %d to destroy", p.Add, p.Change, p.Destroy)
+}
+
+type planJSON struct {
+	ResourceChanges []struct {
+		Address string `json:"address"`
+		Change  struct {
+			Actions []string               `json:"actions"`
+			Before  map[string]interface{} `json:"before"`
+			After   map[string]interface{} `json:"after"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+}
+
+// ParsePlan summarize the output of terraform show -json
+func ParsePlan(b []byte) (*Plan, error) {
+	var raw planJSON
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode terraform plan %v", err)
+	}
+	var changes struct {
+		ResourceChanges json.RawMessage `json:"resource_changes"`
+	}
+	if err := json.Unmarshal(b, &changes); err != nil {
+		return nil, fmt.Errorf("failed to decode terraform plan %v", err)
+	}
+	sum := sha256.Sum256(changes.ResourceChanges)
+	plan := &Plan{Hash: hex.EncodeToString(sum[:])}
+	for _, rc := range raw.ResourceChanges {
+		changed := false
+		for _, action := range rc.Change.Actions {
+			switch action {
+			case "create":
+				plan.Add++
+				changed = true
+			case "update":
+				plan.Change++
+				changed = true
+			case "delete":
+				plan.Destroy++
+				changed = true
+			}
+		}
+		if changed {
+			plan.Resources = append(plan.Resources, rc.Address)
+		}
+		if rc.Change.Before == nil || rc.Change.After == nil {
+			continue
+		}
+		var attributes []string
+		for k, v := range rc.Change.After {
+			if !reflect.DeepEqual(rc.Change.Before[k], v) {
+				attributes = append(attributes, rc.Address+"."+k)
+			}
+		}
+		sort.Strings(attributes)
+		plan.Attributes = append(plan.Attributes, attributes...)
+	}
+	return plan, nil
+}
+
+// planLogJSON is a message of the machine readable output of terraform plan -json
+type planLogJSON struct {
+	Type   string `json:"type"`
+	Change struct {
+		Resource struct {
+			Addr string `json:"addr"`
+		} `json:"resource"`
+		Action string `json:"action"`
+	} `json:"change"`
+	Changes struct {
+		Add    int `json:"add"`
+		Change int `json:"change"`
+		Remove int `json:"remove"`
+	} `json:"changes"`
+}
+
+// ParsePlanLog summarize the output of terraform plan -json, it holds the planned actions without their values
+func ParsePlanLog(b []byte) (*Plan, error) {
+	plan := &Plan{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg planLogJSON
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return nil, fmt.Errorf("failed to decode terraform plan output %v", err)
+		}
+		switch msg.Type {
+		case "planned_change":
+			if msg.Change.Action != "noop" && msg.Change.Action != "read" {
+				plan.Resources = append(plan.Resources, msg.Change.Resource.Addr)
+			}
+		case "change_summary":
+			plan.Add = msg.Changes.Add
+			plan.Change = msg.Changes.Change
+			plan.Destroy = msg.Changes.Remove
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read terraform plan output %v", err)
+	}
+	return plan, nil
+}
+
+// CreatePlan run terraform plan and save it to PlanFile
+func CreatePlan(ctx context.Context, e Executor, dir string, env []string) error {
+	_, err := terraform(ctx, e, dir, env, "plan", "-input=false", "-out="+PlanFile)
+	if err != nil {
+		_ = RemovePlan(dir)
+		return err
+	}
+	return nil
+}
+
+// DetectDrift run terraform plan with -detailed-exitcode and return its summary when the real resources differ
+// from the configuration, nil otherwise. The plan is not saved, as it would hold the values of the variables
+func DetectDrift(ctx context.Context, e Executor, dir string, env []string) (*Plan, error) {
+	res, err := e.Run(ctx, Invocation{
+		Dir:  dir,
+		Env:  env,
+		Args: []string{"plan", "-input=false", "-detailed-exitcode", "-json"},
+	})
+	if err == nil {
+		return nil, nil
+	}
+	// exit code 2 means that the plan succeeded with a non-empty diff
+	if tfErr, ok := err.(*Error); !ok || tfErr.ExitCode != 2 || res == nil {
+		return nil, scrubError(err, env)
+	}
+	return ParsePlanLog([]byte(res.Stdout))
+}
+
+// ShowPlan return the summary of the saved plan
+func ShowPlan(ctx context.Context, e Executor, dir string, env []string) (*Plan, error) {
+	out, err := terraform(ctx, e, dir, env, "show", "-json", PlanFile)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePlan([]byte(out))
+}
+
+// ApplyPlan apply exactly the saved plan, which is then removed whether it is applied or not
+func ApplyPlan(ctx context.Context, e Executor, dir string, env []string) error {
+	_, err := terraform(ctx, e, dir, env, "apply", "-input=false", PlanFile)
+	if errR := RemovePlan(dir); err == nil {
+		err = errR
+	}
+	return err
+}
+
+// RemovePlan remove the saved plan of dir, which must not be left in the workspace as it holds the values of the variables
+func RemovePlan(dir string) error {
+	if err := os.Remove(filepath.Join(dir, PlanFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
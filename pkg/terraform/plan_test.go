@@ -0,0 +1,138 @@
+package terraform_test
+
+import (
+	"context"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Plan", func() {
+	It("Should summarize the resource changes of a plan", func() {
+		plan, err := terraform.ParsePlan([]byte(`{
+  "resource_changes": [
+    {"address": "google_sql_database_instance.instance", "change": {"actions": ["delete", "create"]}},
+    {"address": "google_sql_database.database", "change": {"actions": ["update"]}},
+    {"address": "google_sql_user.default", "change": {"actions": ["no-op"]}},
+    {"address": "google_sql_user.additional_users", "change": {"actions": ["create"]}}
+  ]
+}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan.Add).To(Equal(2))
+		Expect(plan.Change).To(Equal(1))
+		Expect(plan.Destroy).To(Equal(1))
+		Expect(plan.Resources).To(Equal([]string{
+			"google_sql_database_instance.instance",
+			"google_sql_database.database",
+			"google_sql_user.additional_users",
+		}))
+		Expect(plan.HasChanges()).To(BeTrue())
+		Expect(plan.String()).To(Equal("2 to add, 1 to change, 1 to destroy"))
+	})
+
+	It("Should identify plans by their resource changes", func() {
+		plan1, err := terraform.ParsePlan([]byte(`{"timestamp": "1", "resource_changes": [{"address": "a", "change": {"actions": ["delete", "create"]}}]}`))
+		Expect(err).ToNot(HaveOccurred())
+		plan2, err := terraform.ParsePlan([]byte(`{"timestamp": "2", "resource_changes": [{"address": "a", "change": {"actions": ["delete", "create"]}}]}`))
+		Expect(err).ToNot(HaveOccurred())
+		plan3, err := terraform.ParsePlan([]byte(`{"resource_changes": [{"address": "b", "change": {"actions": ["delete", "create"]}}]}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan1.Hash).To(Equal(plan2.Hash))
+		Expect(plan1.Hash).ToNot(Equal(plan3.Hash))
+		Expect(plan1.IsDestructive()).To(BeTrue())
+	})
+
+	It("Should report no changes for an empty plan", func() {
+		plan, err := terraform.ParsePlan([]byte(`{"format_version": "0.1"}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan.HasChanges()).To(BeFalse())
+	})
+
+	It("Should fail on invalid plan", func() {
+		_, err := terraform.ParsePlan([]byte(`Error: no plan`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should list the updated attributes", func() {
+		plan, err := terraform.ParsePlan([]byte(driftPlan))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan.Attributes).To(Equal([]string{
+			"google_sql_database_instance.instance.deletion_protection",
+			"google_sql_database_instance.instance.settings",
+		}))
+	})
+})
+
+const driftPlan = `{
+  "resource_changes": [
+    {"address": "google_sql_database_instance.instance", "change": {
+      "actions": ["update"],
+      "before": {"name": "my-instance", "deletion_protection": true, "settings": [{"tier": "db-custom-1-3840"}]},
+      "after": {"name": "my-instance", "deletion_protection": false, "settings": [{"tier": "db-f1-micro"}]}
+    }},
+    {"address": "google_sql_database.database", "change": {"actions": ["no-op"], "before": {"name": "db"}, "after": {"name": "db"}}}
+  ]
+}`
+
+const driftLog = `{"@level":"info","@message":"Terraform 0.15.5","type":"version","terraform":"0.15.5","ui":"0.1.0"}
+{"@level":"info","@message":"google_sql_database_instance.instance: Plan to update","type":"planned_change","change":{"resource":{"addr":"google_sql_database_instance.instance"},"action":"update"}}
+{"@level":"info","@message":"google_sql_database.database: Plan to read","type":"planned_change","change":{"resource":{"addr":"google_sql_database.database"},"action":"read"}}
+{"@level":"info","@message":"Plan: 0 to add, 1 to change, 0 to destroy.","type":"change_summary","changes":{"add":0,"change":1,"remove":0,"operation":"plan"}}`
+
+var _ = Describe("DetectDrift", func() {
+	var executor *terraform.FakeExecutor
+
+	BeforeEach(func() {
+		executor = terraform.NewFakeExecutor()
+	})
+
+	It("Should return no plan when the resources match the configuration", func() {
+		plan, err := terraform.DetectDrift(context.Background(), executor, "instance", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan).To(BeNil())
+		Expect(executor.Commands()).To(Equal([]string{"instance/plan"}))
+		Expect(executor.Invocations()[0].Args).To(ContainElement("-detailed-exitcode"))
+	})
+
+	It("Should return the plan when terraform reports changes, without saving it", func() {
+		executor.On("plan", terraform.FakeResponse{ExitCode: 2, Stdout: driftLog})
+		plan, err := terraform.DetectDrift(context.Background(), executor, "instance", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan.Change).To(Equal(1))
+		Expect(plan.Resources).To(Equal([]string{"google_sql_database_instance.instance"}))
+		Expect(executor.Commands()).To(Equal([]string{"instance/plan"}))
+		for _, arg := range executor.Invocations()[0].Args {
+			Expect(arg).ToNot(HavePrefix("-out"))
+		}
+	})
+
+	It("Should fail when terraform plan fails", func() {
+		executor.On("plan", terraform.FakeResponse{ExitCode: 1, Stderr: "Error: invalid credentials"})
+		_, err := terraform.DetectDrift(context.Background(), executor, "instance", nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("ApplyPlan", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "instance")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, terraform.PlanFile), []byte("plan"), 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("Should remove the saved plan even when it fails to apply", func() {
+		executor := terraform.NewFakeExecutor().On("apply", terraform.FakeResponse{ExitCode: 1, Stderr: "Error: quota exceeded"})
+		Expect(terraform.ApplyPlan(context.Background(), executor, dir, nil)).ToNot(Succeed())
+		Expect(filepath.Join(dir, terraform.PlanFile)).ToNot(BeAnExistingFile())
+	})
+})
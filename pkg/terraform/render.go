@@ -7,7 +7,6 @@ import (
 
 var (
 	providerName         = "google"
-	backendType          = "gcs"
 	dataBaseResourceName = providerName + "_" + "sql_database"
 	instanceResourceName = dataBaseResourceName + "_" + "instance"
 	userResourceName     = providerName + "_" + "sql_user"
@@ -15,7 +14,7 @@ var (
 )
 
 const (
-	providerVersion = "3.5.0"
+	providerVersion = "3.40.0"
 )
 
 func RenderDatabaseResource(databaseSpec interface{}) ([]byte, error) {
@@ -89,6 +88,12 @@ func RenderAdditionalSqlUserResource(userSpec interface{}, value interface{}) ([
 	return res, nil
 }
 
+// RenderPasswordVariable render the sensitive variable holding the password of a user. It is optional, so that
+// the resources can be destroyed without the passwords
+func RenderPasswordVariable(name string) []byte {
+	return []byte(`"variable":{ "` + name + `":{ "type": "string", "sensitive": true, "default": null } },`)
+}
+
 func RenderInstanceResource(instanceSpec interface{}) ([]byte, error) {
 	res := []byte(`"resource":{ "` + instanceResourceName + `":{ "instance":`)
 	mapD := structs.Map(instanceSpec)
@@ -104,10 +109,10 @@ func RenderInstanceResource(instanceSpec interface{}) ([]byte, error) {
 }
 
 func RenderInstanceOutput() []byte {
-	res := []byte(`output "connectionName" { value = google_sql_database_instance.instance.connection_name }`)
-	res2 := []byte(`output "connectionIPAddress" {  value = google_sql_database_instance.instance.private_ip_address }`)
-	res = append(res, []byte("\n")...)
-	res = append(res, res2...)
+	var res []byte
+	for _, o := range InstanceOutputs {
+		res = append(res, []byte(`output "`+o.Name+`" { value = `+o.Value+` }`+"\n")...)
+	}
 
 	return res
 }
@@ -116,6 +121,10 @@ func RenderBucketResource(bucketSpec interface{}) ([]byte, error) {
 	b := []byte(`{ "resource":{ "` + bucketResourceName + `":{ "bucket":`)
 
 	mapB := structs.Map(bucketSpec)
+	// The bucket holds the terraform states, every version of them is kept
+	mapB["versioning"] = map[string]bool{
+		"enabled": true,
+	}
 
 	valB, err := util.ToJson(mapB)
 	if err != nil {
@@ -127,7 +136,7 @@ func RenderBucketResource(bucketSpec interface{}) ([]byte, error) {
 	return b, nil
 }
 
-func RenderRemoteBackend(backendSpec interface{}) ([]byte, error) {
+func RenderRemoteBackend(backendType string, backendSpec interface{}) ([]byte, error) {
 	b := []byte(`{ "terraform": { "backend": { "` + backendType + `": `)
 	mapB := structs.Map(backendSpec)
 
@@ -143,9 +152,13 @@ func RenderRemoteBackend(backendSpec interface{}) ([]byte, error) {
 	return b, nil
 }
 
-func RenderProvider(providerSpec interface{}) ([]byte, error) {
+// RenderProvider render the google provider at version, the default version when empty
+func RenderProvider(providerSpec interface{}, version string) ([]byte, error) {
+	if version == "" {
+		version = providerVersion
+	}
 	p := []byte(`{ "provider": { "` + providerName + `":`)
-	t := []byte(`"terraform": { "required_providers": { "` + providerName + `": { "source": "hashicorp/google", "version": "` + providerVersion + `" } }`)
+	t := []byte(`"terraform": { "required_providers": { "` + providerName + `": { "source": "hashicorp/google", "version": "` + version + `" } }`)
 
 	mapP := structs.Map(providerSpec)
 	valP, err := util.ToJson(mapP)
@@ -0,0 +1,104 @@
+// +build integration
+
+package terraform_test
+
+import (
+	"context"
+	"encoding/json"
+	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
+	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// The s3 backend is tested against the S3 compatible store at TERRAK8S_S3_ENDPOINT, e.g. the MinIO
+// started by make test-s3, with a terraform binary in the PATH
+var _ = Describe("S3 backend", func() {
+	var (
+		dir      string
+		endpoint string
+		env      []string
+		runner   *terraform.Runner
+		cr       *sqlv1alpha1.PostgreSql
+		ctx      context.Context
+	)
+
+	getenv := func(name, value string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		return value
+	}
+
+	BeforeEach(func() {
+		endpoint = os.Getenv("TERRAK8S_S3_ENDPOINT")
+		if endpoint == "" {
+			Skip("TERRAK8S_S3_ENDPOINT is not set")
+		}
+		if _, err := exec.LookPath("terraform"); err != nil {
+			Skip("terraform is not installed")
+		}
+		ctx = context.Background()
+		root, err := ioutil.TempDir("", "s3")
+		Expect(err).ToNot(HaveOccurred())
+		dir = filepath.Join(root, "instance")
+		Expect(os.MkdirAll(dir, 0700)).To(Succeed())
+		env = []string{
+			"AWS_ACCESS_KEY_ID=" + getenv("TERRAK8S_S3_ACCESS_KEY", "minioadmin"),
+			"AWS_SECRET_ACCESS_KEY=" + getenv("TERRAK8S_S3_SECRET_KEY", "minioadmin"),
+		}
+		runner = terraform.NewRunner(5 * time.Minute)
+		cr = &sqlv1alpha1.PostgreSql{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-instance-" + rand.String(6), Namespace: "integration"},
+			Spec: sqlv1alpha1.PostgreSqlSpec{
+				RemoteState: sqlv1alpha1.PostgresqlInstanceBackend{
+					Type: sqlv1alpha1.BackendS3,
+					S3: &sqlv1alpha1.PostgresqlInstanceS3Backend{
+						Endpoint:       endpoint,
+						Bucket:         getenv("TERRAK8S_S3_BUCKET", "tfstate"),
+						ForcePathStyle: true,
+					},
+				},
+			},
+		}
+		Expect(terraform.GenerateProviderAndBackendTF(cr, dir, nil)).To(Succeed())
+		// The google provider is not needed to store a state
+		Expect(os.Remove(filepath.Join(dir, "provider.tf.json"))).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "main.tf"), []byte(`output "backend" { value = "s3" }`), 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if dir != "" {
+			Expect(os.RemoveAll(filepath.Dir(dir))).To(Succeed())
+		}
+	})
+
+	It("Should store the state in the bucket", func() {
+		Expect(terraform.Init(ctx, runner, dir, env)).To(Succeed())
+		Expect(terraform.Apply(ctx, runner, dir, env)).To(Succeed())
+
+		// A new workspace reads the state back from the bucket
+		Expect(os.RemoveAll(filepath.Join(dir, ".terraform"))).To(Succeed())
+		Expect(terraform.Init(ctx, runner, dir, env)).To(Succeed())
+		b, err := terraform.StatePull(ctx, runner, dir, env)
+		Expect(err).ToNot(HaveOccurred())
+		state := struct {
+			Serial  int64 `json:"serial"`
+			Outputs map[string]struct {
+				Value string `json:"value"`
+			} `json:"outputs"`
+		}{}
+		Expect(json.Unmarshal(b, &state)).To(Succeed())
+		Expect(state.Serial).To(BeNumerically(">", 0))
+		Expect(state.Outputs["backend"].Value).To(Equal("s3"))
+
+		Expect(terraform.Destroy(ctx, runner, filepath.Dir(dir), env, "instance")).To(Succeed())
+	})
+})
@@ -1,12 +1,138 @@
 package terraform
 
 import (
+	"fmt"
+	"strings"
+
 	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
 	"github.com/HamzaZo/terrak8s-operator/pkg/util"
 )
 
-func GenerateProviderAndBackendTF(instance *sqlv1alpha1.PostgreSql, dir string) error {
-	b, err := RenderRemoteBackend(instance.Spec.RemoteState)
+// StateLabel is set on the Secrets of the kubernetes backend with the name of their PostgreSql
+const StateLabel = sqlv1alpha1.AnnotationPrefix + "postgresql"
+
+// KubernetesBackend is the configuration of the kubernetes backend, which stores the state in the
+// Secret tfstate-default-<secret_suffix> of the PostgreSql namespace
+type KubernetesBackend struct {
+	SecretSuffix string            `tf:"secret_suffix"`
+	Namespace    string            `tf:"namespace"`
+	Labels       map[string]string `tf:"labels"`
+}
+
+// HTTPBackend is the configuration of the http backend, the state is locked at its address. The
+// password is passed through the TF_HTTP_PASSWORD environment variable, see StateEndpoint.Env
+type HTTPBackend struct {
+	Address       string `tf:"address"`
+	LockAddress   string `tf:"lock_address"`
+	UnlockAddress string `tf:"unlock_address"`
+	Username      string `tf:"username"`
+}
+
+// S3Backend is the configuration of the s3 backend, the access keys are passed through the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+type S3Backend struct {
+	Bucket         string `tf:"bucket"`
+	Key            string `tf:"key"`
+	Region         string `tf:"region"`
+	Endpoint       string `tf:"endpoint,omitempty"`
+	ForcePathStyle bool   `tf:"force_path_style,omitempty"`
+	// S3 compatible stores do not implement the AWS APIs checked by default
+	SkipCredentialsValidation bool `tf:"skip_credentials_validation,omitempty"`
+	SkipMetadataAPICheck      bool `tf:"skip_metadata_api_check,omitempty"`
+	SkipRegionValidation      bool `tf:"skip_region_validation,omitempty"`
+}
+
+// StateEndpoint is the state of a PostgreSql served by the http backend of the manager
+type StateEndpoint struct {
+	// Address of the state
+	Address string
+	// Username and Password authenticate the runs of the PostgreSql
+	Username string
+	Password string
+}
+
+// Env return the environment of the terraform runs authenticating with the password of the endpoint
+func (e *StateEndpoint) Env() []string {
+	return []string{"TF_HTTP_PASSWORD=" + e.Password}
+}
+
+// BackendConfig return the configuration of the terraform backend of the instance, the http
+// backend is configured with endpoint
+func BackendConfig(instance *sqlv1alpha1.PostgreSql, endpoint *StateEndpoint) (interface{}, error) {
+	switch instance.Spec.RemoteState.GetType() {
+	case sqlv1alpha1.BackendKubernetes:
+		return KubernetesBackend{
+			SecretSuffix: "postgresql-" + instance.Name,
+			Namespace:    instance.Namespace,
+			Labels:       map[string]string{StateLabel: instance.Name},
+		}, nil
+	case sqlv1alpha1.BackendS3:
+		s3 := instance.Spec.RemoteState.S3
+		if s3 == nil {
+			return nil, fmt.Errorf("the s3 backend of %s/%s is not configured", instance.Namespace, instance.Name)
+		}
+		config := S3Backend{
+			Bucket:         s3.Bucket,
+			Key:            s3.Key,
+			Region:         s3.Region,
+			Endpoint:       s3.Endpoint,
+			ForcePathStyle: s3.ForcePathStyle,
+		}
+		if config.Key == "" {
+			config.Key = instance.Namespace + "/" + instance.Name + "/terraform.tfstate"
+		}
+		if config.Region == "" {
+			config.Region = "us-east-1"
+		}
+		if config.Endpoint != "" {
+			config.SkipCredentialsValidation = true
+			config.SkipMetadataAPICheck = true
+			config.SkipRegionValidation = true
+		}
+		return config, nil
+	case sqlv1alpha1.BackendHTTP:
+		if endpoint == nil {
+			return nil, fmt.Errorf("the http backend of %s/%s is not served by the manager", instance.Namespace, instance.Name)
+		}
+		return HTTPBackend{
+			Address:       endpoint.Address,
+			LockAddress:   endpoint.Address,
+			UnlockAddress: endpoint.Address,
+			Username:      endpoint.Username,
+		}, nil
+	}
+	return instance.Spec.RemoteState, nil
+}
+
+// StateLocation return where the backend of the instance stores its state, the state must be migrated
+// whenever it changes
+func StateLocation(instance *sqlv1alpha1.PostgreSql) (string, error) {
+	switch instance.Spec.RemoteState.GetType() {
+	case sqlv1alpha1.BackendKubernetes:
+		return "kubernetes://" + instance.Namespace + "/tfstate-default-postgresql-" + instance.Name, nil
+	case sqlv1alpha1.BackendS3:
+		config, err := BackendConfig(instance, nil)
+		if err != nil {
+			return "", err
+		}
+		s3 := config.(S3Backend)
+		if s3.Endpoint != "" {
+			return strings.TrimSuffix(s3.Endpoint, "/") + "/" + s3.Bucket + "/" + s3.Key, nil
+		}
+		return "s3://" + s3.Bucket + "/" + s3.Key, nil
+	case sqlv1alpha1.BackendHTTP:
+		// The state is served from the state Secret of the instance whatever the address of the manager
+		return "http://" + instance.Namespace + "/" + instance.Name, nil
+	}
+	return "gs://" + instance.Spec.RemoteState.BucketName + "/" + instance.Spec.RemoteState.BucketPrefix, nil
+}
+
+func GenerateProviderAndBackendTF(instance *sqlv1alpha1.PostgreSql, dir string, endpoint *StateEndpoint) error {
+	config, err := BackendConfig(instance, endpoint)
+	if err != nil {
+		return err
+	}
+	b, err := RenderRemoteBackend(string(instance.Spec.RemoteState.GetType()), config)
 	if err != nil {
 		return err
 	}
@@ -18,7 +144,7 @@ func GenerateProviderAndBackendTF(instance *sqlv1alpha1.PostgreSql, dir string)
 	if err != nil {
 		return err
 	}
-	p, err := RenderProvider(instance.Spec.Project)
+	p, err := RenderProvider(instance.Spec.Project, instance.Spec.Project.ProviderVersion)
 	if err != nil {
 		return err
 	}
@@ -46,7 +172,7 @@ func GenerateBucketTF(instance *sqlv1alpha1.PostgreSql, dir string) error {
 	if err != nil {
 		return err
 	}
-	p, err := RenderProvider(instance.Spec.Project)
+	p, err := RenderProvider(instance.Spec.Project, instance.Spec.Project.ProviderVersion)
 	if err != nil {
 		return err
 	}
@@ -82,19 +208,38 @@ func GenerateTFDatabases(instance *sqlv1alpha1.PostgreSql) ([]byte, error) {
 	return output, nil
 }
 
+// PasswordVariable return the terraform variable holding the password of the i-th user
+func PasswordVariable(i int) string {
+	return fmt.Sprintf("user_%d_password", i)
+}
+
+// PasswordEnv return the passwords of the users as the TF_VAR environment of the terraform runs, the passwords
+// are never written to the workspace
+func PasswordEnv(instance *sqlv1alpha1.PostgreSql, value map[string][]byte) []string {
+	var env []string
+	for i, k := range instance.Spec.Users {
+		if v, ok := value[k.Password.SecretKeyRef.Key]; ok {
+			env = append(env, "TF_VAR_"+PasswordVariable(i)+"="+string(v))
+		}
+	}
+	return env
+}
+
 func GenerateTFUsers(instance *sqlv1alpha1.PostgreSql, value map[string][]byte) ([]byte, error) {
 	var output []byte
 
 	for i, k := range instance.Spec.Users {
-		if v, ok := value[k.Password.SecretKeyRef.Key]; ok {
+		if _, ok := value[k.Password.SecretKeyRef.Key]; ok {
+			output = append(output, RenderPasswordVariable(PasswordVariable(i))...)
+			password := "${var." + PasswordVariable(i) + "}"
 			if i == 0 {
-				u1, err := RenderSqlUserResource(k, string(v))
+				u1, err := RenderSqlUserResource(k, password)
 				if err != nil {
 					return nil, err
 				}
 				output = append(output, u1...)
 			} else {
-				u2, err := RenderAdditionalSqlUserResource(k, string(v))
+				u2, err := RenderAdditionalSqlUserResource(k, password)
 				if err != nil {
 					return nil, err
 				}
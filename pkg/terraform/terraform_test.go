@@ -3,21 +3,25 @@ package terraform_test
 import (
 	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
 	"github.com/HamzaZo/terrak8s-operator/pkg/terraform"
-	"github.com/HamzaZo/terrak8s-operator/pkg/util"
+	"github.com/HamzaZo/terrak8s-operator/pkg/workspace"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"io/ioutil"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
 	"path/filepath"
 )
 
 var _ = Describe("Terraform", func() {
 	var (
+		root string
 		dir string
 		cr  sqlv1alpha1.PostgreSql
 		err error
 		val map[string][]byte
 		val1 map[string][]byte
+		destroy = true
 	)
 	testExpectedBucket := `
 {
@@ -36,7 +40,10 @@ var _ = Describe("Terraform", func() {
         "location": "region-1",
         "name": "my-bucket",
         "project": "my-project",
-        "storage_class": "STANDARD"
+        "storage_class": "STANDARD",
+        "versioning": {
+          "enabled": true
+        }
       }
     }
   }
@@ -54,12 +61,59 @@ var _ = Describe("Terraform", func() {
       "required_providers": {
         "google": {
           "source": "hashicorp/google",
-          "version": "3.5.0"
+          "version": "3.40.0"
         }
       }
     }
   }
 }
+`
+	testExpectedKubernetesBackend := `
+{
+  "terraform": {
+    "backend": {
+      "kubernetes": {
+        "labels": {
+          "sql.terrak8s.io/postgresql": "my-instance"
+        },
+        "namespace": "default",
+        "secret_suffix": "postgresql-my-instance"
+      }
+    }
+  }
+}
+`
+	testExpectedHTTPBackend := `
+{
+  "terraform": {
+    "backend": {
+      "http": {
+        "address": "http://127.0.0.1:8082/state/default/my-instance",
+        "lock_address": "http://127.0.0.1:8082/state/default/my-instance",
+        "unlock_address": "http://127.0.0.1:8082/state/default/my-instance",
+        "username": "terrak8s"
+      }
+    }
+  }
+}
+`
+	testExpectedS3Backend := `
+{
+  "terraform": {
+    "backend": {
+      "s3": {
+        "bucket": "tfstate",
+        "key": "default/my-instance/terraform.tfstate",
+        "region": "us-east-1",
+        "endpoint": "http://127.0.0.1:9000",
+        "force_path_style": true,
+        "skip_credentials_validation": true,
+        "skip_metadata_api_check": true,
+        "skip_region_validation": true
+      }
+    }
+  }
+}
 `
 	testExpectedBackend := `
 {
@@ -97,6 +151,13 @@ var _ = Describe("Terraform", func() {
       }
     }
   },
+  "variable": {
+    "user_0_password": {
+      "default": null,
+      "sensitive": true,
+      "type": "string"
+    }
+  },
   "resource": {
     "google_sql_user": {
       "default": {
@@ -105,11 +166,18 @@ var _ = Describe("Terraform", func() {
         ],
         "instance": "my-instance",
         "name": "user-1",
-        "password": "jEnv2000!",
+        "password": "${var.user_0_password}",
         "project": "my-project"
       }
     }
   },
+  "variable": {
+    "user_1_password": {
+      "default": null,
+      "sensitive": true,
+      "type": "string"
+    }
+  },
   "resource": {
     "google_sql_user": {
       "additional_users": {
@@ -118,7 +186,7 @@ var _ = Describe("Terraform", func() {
         ],
         "instance": "my-instance",
         "name": "user-2",
-        "password": "jEnv2001!",
+        "password": "${var.user_1_password}",
         "project": "my-project"
       }
     }
@@ -182,6 +250,13 @@ var _ = Describe("Terraform", func() {
       }
     }
   },
+  "variable": {
+    "user_0_password": {
+      "default": null,
+      "sensitive": true,
+      "type": "string"
+    }
+  },
   "resource": {
     "google_sql_user": {
       "default": {
@@ -190,7 +265,7 @@ var _ = Describe("Terraform", func() {
         ],
         "instance": "my-instance",
         "name": "user-1",
-        "password": "jEnv2000!",
+        "password": "${var.user_0_password}",
         "project": "my-project"
       }
     }
@@ -254,6 +329,13 @@ var _ = Describe("Terraform", func() {
       }
     }
   },
+  "variable": {
+    "user_0_password": {
+      "default": null,
+      "sensitive": true,
+      "type": "string"
+    }
+  },
   "resource": {
     "google_sql_user": {
       "default": {
@@ -262,11 +344,18 @@ var _ = Describe("Terraform", func() {
         ],
         "instance": "my-instance",
         "name": "user-1",
-        "password": "jEnv2000!",
+        "password": "${var.user_0_password}",
         "project": "my-project"
       }
     }
   },
+  "variable": {
+    "user_1_password": {
+      "default": null,
+      "sensitive": true,
+      "type": "string"
+    }
+  },
   "resource": {
     "google_sql_user": {
       "additional_users": {
@@ -275,7 +364,7 @@ var _ = Describe("Terraform", func() {
         ],
         "instance": "my-instance",
         "name": "user-2",
-        "password": "jEnv2001!",
+        "password": "${var.user_1_password}",
         "project": "my-project"
       }
     }
@@ -346,7 +435,7 @@ var _ = Describe("Terraform", func() {
 					Name:         "my-bucket",
 					Project:      "my-project",
 					Location:     "region-1",
-					Destroy:      true,
+					Destroy:      &destroy,
 					StorageClass: "STANDARD",
 					LifecycleRule: sqlv1alpha1.PostgresqlInstanceStorageBucketLifecycleRules{
 						Condition: map[string]int{
@@ -423,37 +512,96 @@ var _ = Describe("Terraform", func() {
 			},
 		}
 		val = map[string][]byte{
-			"password" : []byte("jEnv2000!"),
+			"mykey" : []byte("jEnv2000!"),
 		}
-		dir, err = util.CreateDirectory(cr.Namespace, cr.Name)
+		root, err = ioutil.TempDir("", "workspaces")
+		Expect(err).ToNot(HaveOccurred(), "failed to create workspaces root")
+		dir, err = workspace.NewManager(root).Create(types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name})
 		Expect(err).ToNot(HaveOccurred(), "failed to create directory")
 	})
 
 	AfterEach(func() {
-		err = util.HouseCleaning(dir)
+		err = os.RemoveAll(root)
 		Expect(err).ToNot(HaveOccurred(), "failed to clean directory")
 	})
 	Context("Generate provider/backend", func() {
 		It("Should write tf resources to files", func() {
-			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"))
+			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"), nil)
 			Expect(err).ToNot(HaveOccurred(), "failed to generate tf files")
 			Expect(filepath.Join(dir, "instance") + "/" + "provider.tf.json").Should(BeARegularFile())
 			Expect(filepath.Join(dir, "instance") + "/" + "backend.tf.json").Should(BeARegularFile())
 		})
 		It("Should generate provider tf from CR spec", func() {
-			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"))
+			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"), nil)
 			Expect(err).ToNot(HaveOccurred(), "failed to generate tf files")
 			b, err := ioutil.ReadFile(filepath.Join(dir, "instance") + "/" + "provider.tf.json")
 			Expect(err).ToNot(HaveOccurred(), "cannot read file")
 			Expect(string(b)).Should(MatchJSON(testExpectedProvider))
 		})
+		It("Should render the impersonated service account in the provider", func() {
+			cr.Spec.Project.AuthMode = sqlv1alpha1.AuthWorkloadIdentity
+			cr.Spec.Project.ImpersonateServiceAccount = "demo@my-project.iam.gserviceaccount.com"
+			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"), nil)
+			Expect(err).ToNot(HaveOccurred(), "failed to generate tf files")
+			b, err := ioutil.ReadFile(filepath.Join(dir, "instance") + "/" + "provider.tf.json")
+			Expect(err).ToNot(HaveOccurred(), "cannot read file")
+			Expect(string(b)).Should(ContainSubstring(`"impersonate_service_account": "demo@my-project.iam.gserviceaccount.com"`))
+			Expect(string(b)).ShouldNot(ContainSubstring("WorkloadIdentity"))
+		})
+		It("Should render the provider version of the CR spec", func() {
+			cr.Spec.Project.ProviderVersion = "3.51.0"
+			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"), nil)
+			Expect(err).ToNot(HaveOccurred(), "failed to generate tf files")
+			b, err := ioutil.ReadFile(filepath.Join(dir, "instance") + "/" + "provider.tf.json")
+			Expect(err).ToNot(HaveOccurred(), "cannot read file")
+			Expect(string(b)).Should(ContainSubstring(`"version": "3.51.0"`))
+			Expect(string(b)).ShouldNot(ContainSubstring("providerVersion"))
+		})
 		It("Should generate backend tf from CR spec", func() {
-			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"))
+			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"), nil)
 			Expect(err).ToNot(HaveOccurred(), "failed to generate tf files")
 			b, err := ioutil.ReadFile(filepath.Join(dir, "instance") + "/" + "backend.tf.json")
 			Expect(err).ToNot(HaveOccurred(), "cannot read file")
 			Expect(string(b)).Should(MatchJSON(testExpectedBackend))
 		})
+		It("Should generate the kubernetes backend tf from CR spec", func() {
+			cr.Spec.RemoteState = sqlv1alpha1.PostgresqlInstanceBackend{Type: sqlv1alpha1.BackendKubernetes}
+			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"), nil)
+			Expect(err).ToNot(HaveOccurred(), "failed to generate tf files")
+			b, err := ioutil.ReadFile(filepath.Join(dir, "instance") + "/" + "backend.tf.json")
+			Expect(err).ToNot(HaveOccurred(), "cannot read file")
+			Expect(string(b)).Should(MatchJSON(testExpectedKubernetesBackend))
+		})
+		It("Should generate the s3 backend tf from CR spec", func() {
+			cr.Spec.RemoteState = sqlv1alpha1.PostgresqlInstanceBackend{
+				Type: sqlv1alpha1.BackendS3,
+				S3: &sqlv1alpha1.PostgresqlInstanceS3Backend{
+					Endpoint:       "http://127.0.0.1:9000",
+					Bucket:         "tfstate",
+					ForcePathStyle: true,
+					CredentialsSecretRef: sqlv1alpha1.PostgresqlInstanceS3Credentials{
+						Name: "minio-keys",
+					},
+				},
+			}
+			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"), nil)
+			Expect(err).ToNot(HaveOccurred(), "failed to generate tf files")
+			b, err := ioutil.ReadFile(filepath.Join(dir, "instance") + "/" + "backend.tf.json")
+			Expect(err).ToNot(HaveOccurred(), "cannot read file")
+			Expect(string(b)).Should(MatchJSON(testExpectedS3Backend))
+		})
+		It("Should generate the http backend tf from CR spec", func() {
+			cr.Spec.RemoteState = sqlv1alpha1.PostgresqlInstanceBackend{Type: sqlv1alpha1.BackendHTTP}
+			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"), nil)
+			Expect(err).To(HaveOccurred())
+			endpoint := &terraform.StateEndpoint{Address: "http://127.0.0.1:8082/state/default/my-instance", Username: "terrak8s", Password: "secret"}
+			err = terraform.GenerateProviderAndBackendTF(&cr, filepath.Join(dir, "instance"), endpoint)
+			Expect(err).ToNot(HaveOccurred(), "failed to generate tf files")
+			b, err := ioutil.ReadFile(filepath.Join(dir, "instance") + "/" + "backend.tf.json")
+			Expect(err).ToNot(HaveOccurred(), "cannot read file")
+			Expect(string(b)).Should(MatchJSON(testExpectedHTTPBackend))
+			Expect(endpoint.Env()).To(Equal([]string{"TF_HTTP_PASSWORD=secret"}))
+		})
 
 
 	})
@@ -502,6 +650,17 @@ var _ = Describe("Terraform", func() {
 			Expect(err).ToNot(HaveOccurred(), "cannot read file")
 			Expect(string(b)).Should(MatchJSON(testExpectedInstance))
 		})
+		It("Should pass the passwords through sensitive variables only", func() {
+			err = terraform.GenerateTFInstance(&cr, filepath.Join(dir, "instance"), val)
+			Expect(err).ToNot(HaveOccurred(), "failed to generate tf files")
+			b, err := ioutil.ReadFile(filepath.Join(dir, "instance") + "/" + "main.tf.json")
+			Expect(err).ToNot(HaveOccurred(), "cannot read file")
+			Expect(string(b)).ShouldNot(ContainSubstring("jEnv2000!"))
+			Expect(terraform.PasswordEnv(&cr, val)).To(Equal([]string{"TF_VAR_user_0_password=jEnv2000!"}))
+			info, err := os.Stat(filepath.Join(dir, "instance") + "/" + "main.tf.json")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
 
 	})
 	Context ("Generate instance with multiple users", func() {
@@ -525,7 +684,7 @@ var _ = Describe("Terraform", func() {
 						Name:         "my-bucket",
 						Project:      "my-project",
 						Location:     "region-1",
-						Destroy:      true,
+						Destroy:      &destroy,
 						StorageClass: "STANDARD",
 						LifecycleRule: sqlv1alpha1.PostgresqlInstanceStorageBucketLifecycleRules{
 							Condition: map[string]int{
@@ -613,10 +772,11 @@ var _ = Describe("Terraform", func() {
 				},
 			}
 			val1 = map[string][]byte{
-				"password" : []byte("jEnv2000!"),
-				"password2": []byte("jEnv2001!"),
+				"mykey1" : []byte("jEnv2000!"),
+				"mykey2": []byte("jEnv2001!"),
 			}
-			dir, err = util.CreateDirectory(instance.Namespace, instance.Name)
+			cr = instance
+			dir, err = workspace.NewManager(root).Create(types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name})
 			Expect(err).ToNot(HaveOccurred(), "failed to create directory")
 		})
 		It("Should generate instance tf with two users and one database", func() {
@@ -648,7 +808,7 @@ var _ = Describe("Terraform", func() {
 						Name:         "my-bucket",
 						Project:      "my-project",
 						Location:     "region-1",
-						Destroy:      true,
+						Destroy:      &destroy,
 						StorageClass: "STANDARD",
 						LifecycleRule: sqlv1alpha1.PostgresqlInstanceStorageBucketLifecycleRules{
 							Condition: map[string]int{
@@ -742,7 +902,12 @@ var _ = Describe("Terraform", func() {
 					},
 				},
 			}
-			dir, err = util.CreateDirectory(instance2.Namespace, instance2.Name)
+			cr = instance2
+			val1 = map[string][]byte{
+				"mykey1": []byte("jEnv2000!"),
+				"mykey2": []byte("jEnv2001!"),
+			}
+			dir, err = workspace.NewManager(root).Create(types.NamespacedName{Namespace: instance2.Namespace, Name: instance2.Name})
 			Expect(err).ToNot(HaveOccurred(), "failed to create directory")
 		})
 		It("Should generate instance tf with two users and two database", func() {
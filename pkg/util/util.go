@@ -4,19 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	sqlv1alpha1 "github.com/HamzaZo/terrak8s-operator/api/v1alpha1"
-	"github.com/go-logr/logr"
 	jsoniter "github.com/json-iterator/go"
-	"github.com/mitchellh/mapstructure"
 	"io/ioutil"
 	kubeApiMetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"os"
-	"path/filepath"
-	"strings"
 	"unicode"
 )
 
 var (
-	log           logr.Logger
 	isValidLength = false
 	isUpperChar   = false
 	isLowerChar   = false
@@ -54,44 +49,15 @@ func ToJson(content interface{}) ([]byte, error) {
 	return val, nil
 }
 
-//CreateDirectory create a directory to host generated tf based on namespace and instance name
-func CreateDirectory(namespace string, instance string) (string, error) {
-	var fullName string
-	paths := []string{"instance", "bucket"}
-	parentDir := os.TempDir()
-	pathName := parentDir + "/" + namespace + "_" + instance
-	for _, k := range paths {
-		fullName = filepath.Join(pathName, k)
-		_, err := os.Stat(fullName)
-		if os.IsNotExist(err) {
-			err = os.MkdirAll(fullName, os.ModePerm)
-			if err != nil {
-				log.Error(err, "unable to create directory")
-				return "", err
-			}
-		}
-	}
-
-	return pathName, nil
-}
-
+//WriteToFile write b to the file name of path, only readable by the manager. The mode of an existing
+//file is restored as well
 func WriteToFile(b []byte, path string, name string) error {
-	if err := ioutil.WriteFile(path+"/"+name, b, 0755); err != nil {
+	if err := ioutil.WriteFile(path+"/"+name, b, 0600); err != nil {
 		return err
 	}
-	return nil
-}
-
-//HouseCleaning clean what have been created
-func HouseCleaning(dirPath string) error {
-	err := os.RemoveAll(dirPath)
-	if err != nil {
+	if err := os.Chmod(path+"/"+name, 0600); err != nil {
 		return err
 	}
-	errs := os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
-	if errs != nil {
-		return errs
-	}
 	return nil
 }
 
@@ -129,68 +95,6 @@ func RemoveFinalizer(obj kubeApiMetav1.Object, finalizer string) {
 	}
 }
 
-//UpdateOutput Unmarshal the returned output and update the output status
-func UpdateOutput(instanceOutput *sqlv1alpha1.PostgreSql, output string) (error, *sqlv1alpha1.PostgreSql) {
-	out := extractOutput(output)
-	jsonit := jsoniter.Config{
-		EscapeHTML:             true,
-		SortMapKeys:            true,
-		ValidateJsonRawMessage: true,
-		TagKey:                 "json",
-	}.Froze()
-
-	var d map[string]interface{}
-	finalMap := make(map[string]interface{})
-
-	err := jsonit.Unmarshal(out, &d)
-	if err != nil {
-		return err, nil
-	}
-	for e, v := range d {
-		m := v.(map[string]interface{})
-		for i, k := range m {
-			if i == "value" {
-				finalMap[e] = k
-			}
-		}
-	}
-
-	err = mapstructure.Decode(finalMap, &instanceOutput.Status.Output)
-	if err != nil {
-		return err, nil
-	}
-	return nil, instanceOutput
-}
-
-//extractOutput return the content of output
-func extractOutput(output string) []byte {
-	finder := "{"
-	lengthOfFinder := len(finder)
-	indexOf := strings.Index(output, finder)
-	var finalContent string
-	if indexOf != -1 {
-		// If found get content
-		indexOf += lengthOfFinder
-		end := "Ini"
-		if strings.Contains(output[indexOf:], end) {
-			y := strings.Index(output[indexOf:], end)
-			//10 is the number of the left bytes, while extracting the content of output
-			//it's a dirty workaround to avoid error while preforming Unmarshal of finalContent
-			finalContent = output[indexOf : indexOf+y-10]
-		} else {
-			finalContent = output[indexOf:]
-		}
-	} else {
-		// If not content after empty.
-		finalContent = ""
-	}
-	res := []byte(finalContent)
-	out := []byte(`{`)
-	out = append(out, res...)
-
-	return out
-}
-
 //IsValidPasswordFormat Validate password format
 func IsValidPasswordFormat(password string) bool {
 	if len(password) >= passwordMinLength {
@@ -210,3 +114,50 @@ func IsValidPasswordFormat(password string) bool {
 	}
 	return isValidLength && isUpperChar && isLowerChar && isNumber && isSpecialChar
 }
+
+//GetCondition return the condition with the given type, nil if it does not exist
+func GetCondition(conditions []sqlv1alpha1.PostgreSqlCondition, conditionType sqlv1alpha1.ConditionType) *sqlv1alpha1.PostgreSqlCondition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+//SetCondition add or update a condition, the transition time is only updated when the status changes
+func SetCondition(conditions *[]sqlv1alpha1.PostgreSqlCondition, condition sqlv1alpha1.PostgreSqlCondition) {
+	existing := GetCondition(*conditions, condition.Type)
+	if existing == nil {
+		if condition.LastTransitionTime.IsZero() {
+			condition.LastTransitionTime = kubeApiMetav1.Now()
+		}
+		*conditions = append(*conditions, condition)
+		return
+	}
+	if existing.Status != condition.Status {
+		existing.Status = condition.Status
+		existing.LastTransitionTime = kubeApiMetav1.Now()
+	}
+	existing.Reason = condition.Reason
+	existing.Message = condition.Message
+}
+
+//GetStage return the stage with the given name, nil if it has never run
+func GetStage(stages []sqlv1alpha1.PostgreSqlStage, name sqlv1alpha1.StageName) *sqlv1alpha1.PostgreSqlStage {
+	for i := range stages {
+		if stages[i].Name == name {
+			return &stages[i]
+		}
+	}
+	return nil
+}
+
+//SetStage add or update a stage
+func SetStage(stages *[]sqlv1alpha1.PostgreSqlStage, stage sqlv1alpha1.PostgreSqlStage) {
+	if existing := GetStage(*stages, stage.Name); existing != nil {
+		*existing = stage
+		return
+	}
+	*stages = append(*stages, stage)
+}
@@ -83,15 +83,6 @@ var _ = Describe("Util", func() {
 			Expect(util.IsValidPasswordFormat(password)).To(BeTrue())
 		})
 	})
-	Context("create directory", func() {
-		It("create directory for tf files ", func() {
-			str, err := util.CreateDirectory(cr.Namespace, cr.Name)
-			Expect(err).ToNot(HaveOccurred(), "failed to create directory")
-			parentDir := os.TempDir()
-			Expect(str).To(Equal(parentDir + "/" + cr.Namespace + "_" + cr.Name))
-
-		})
-	})
 	Context("convert and write tf files", func() {
 		BeforeEach(func() {
 			variableMap = map[string]interface{}{
@@ -102,6 +93,11 @@ var _ = Describe("Util", func() {
 			json = []byte(`{"project": "my-project", "region":"europe-west1","zone":"europe-west1-b"}`)
 			parentDir := os.TempDir()
 			fullPath = parentDir + "/" + cr.Namespace + "_" + cr.Name
+			Expect(os.MkdirAll(fullPath, os.ModePerm)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(fullPath)).To(Succeed())
 		})
 		It("return a well formatted json based on tf tag ", func() {
 			out, err := util.ToJson(variableMap)
@@ -115,11 +111,6 @@ var _ = Describe("Util", func() {
 			Expect(err).ToNot(HaveOccurred(), "failed to write to file")
 			Expect(fullPath + "/" + "file.tf.json").Should(BeARegularFile())
 		})
-		It("clean created directory ", func() {
-			err := util.HouseCleaning(fullPath)
-			Expect(err).ToNot(HaveOccurred(), "failed to clean")
-			Expect(fullPath).ShouldNot(BeADirectory())
-		})
 	})
 
 })
@@ -0,0 +1,123 @@
+package workspace
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	// Modules are the terraform root modules of a workspace
+	Modules = []string{"instance", "bucket"}
+)
+
+// dirMode restricts the workspaces to the manager, they hold the rendered backends and the saved plans
+const dirMode os.FileMode = 0700
+
+// Manager hands out the terraform workspaces of the PostgreSqls. Every PostgreSql owns
+// the <Root>/<namespace>/<name> directory, which is kept between reconciles so that
+// .terraform and the downloaded providers survive a restart when Root is a volume.
+type Manager struct {
+	Root string
+}
+
+// NewManager return a Manager storing the workspaces under root
+func NewManager(root string) *Manager {
+	return &Manager{Root: root}
+}
+
+// Path return the workspace directory of a PostgreSql
+func (m *Manager) Path(key types.NamespacedName) string {
+	return filepath.Join(m.Root, key.Namespace, key.Name)
+}
+
+// Create ensure the workspace of a PostgreSql and its modules exist, and return its directory. The
+// workspaces are only reachable by the manager, the directories created by previous versions are restricted too
+func (m *Manager) Create(key types.NamespacedName) (string, error) {
+	if key.Namespace == "" || key.Name == "" {
+		return "", fmt.Errorf("invalid workspace %q", key)
+	}
+	dir := m.Path(key)
+	for _, module := range Modules {
+		if err := os.MkdirAll(filepath.Join(dir, module), dirMode); err != nil {
+			return "", fmt.Errorf("failed to create workspace %v: %v", key, err)
+		}
+	}
+	// Only the directories of the workspace are restricted, the parents may not be owned by the manager
+	dirs := []string{dir}
+	for _, module := range Modules {
+		dirs = append(dirs, filepath.Join(dir, module))
+	}
+	for _, d := range dirs {
+		if err := os.Chmod(d, dirMode); err != nil {
+			return "", fmt.Errorf("failed to restrict workspace %v: %v", key, err)
+		}
+	}
+	return dir, nil
+}
+
+// Remove delete the workspace of a PostgreSql
+func (m *Manager) Remove(key types.NamespacedName) error {
+	if key.Namespace == "" || key.Name == "" {
+		return fmt.Errorf("invalid workspace %q", key)
+	}
+	if err := os.RemoveAll(m.Path(key)); err != nil {
+		return fmt.Errorf("failed to remove workspace %v: %v", key, err)
+	}
+	// Drop the namespace directory once its last workspace is gone
+	_ = os.Remove(filepath.Join(m.Root, key.Namespace))
+	return nil
+}
+
+// List return the PostgreSqls owning a workspace
+func (m *Manager) List() ([]types.NamespacedName, error) {
+	namespaces, err := ioutil.ReadDir(m.Root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []types.NamespacedName
+	for _, ns := range namespaces {
+		if !ns.IsDir() {
+			continue
+		}
+		names, err := ioutil.ReadDir(filepath.Join(m.Root, ns.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if name.IsDir() {
+				keys = append(keys, types.NamespacedName{Namespace: ns.Name(), Name: name.Name()})
+			}
+		}
+	}
+	return keys, nil
+}
+
+// GarbageCollect remove the workspaces whose PostgreSql does not exist anymore, and return them
+func (m *Manager) GarbageCollect(exists func(key types.NamespacedName) (bool, error)) ([]types.NamespacedName, error) {
+	keys, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	var removed []types.NamespacedName
+	for _, key := range keys {
+		ok, err := exists(key)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			continue
+		}
+		if err := m.Remove(key); err != nil {
+			return removed, err
+		}
+		removed = append(removed, key)
+	}
+	return removed, nil
+}
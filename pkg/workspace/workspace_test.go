@@ -0,0 +1,104 @@
+package workspace_test
+
+import (
+	"github.com/HamzaZo/terrak8s-operator/pkg/workspace"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Manager", func() {
+	var (
+		root     string
+		manager  *workspace.Manager
+		instance types.NamespacedName
+		err      error
+	)
+
+	BeforeEach(func() {
+		root, err = ioutil.TempDir("", "workspaces")
+		Expect(err).ToNot(HaveOccurred())
+		manager = workspace.NewManager(root)
+		instance = types.NamespacedName{Namespace: "demo", Name: "my-instance"}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	It("Should create the workspace with its modules under the root", func() {
+		dir, err := manager.Create(instance)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dir).To(Equal(filepath.Join(root, "demo", "my-instance")))
+		Expect(filepath.Join(dir, "instance")).Should(BeADirectory())
+		Expect(filepath.Join(dir, "bucket")).Should(BeADirectory())
+	})
+
+	It("Should restrict the workspaces to the manager", func() {
+		Expect(os.MkdirAll(filepath.Join(root, "demo", "my-instance", "instance"), 0755)).To(Succeed())
+		Expect(os.Chmod(root, 0755)).To(Succeed())
+		dir, err := manager.Create(instance)
+		Expect(err).ToNot(HaveOccurred())
+		for _, d := range []string{dir, filepath.Join(dir, "instance"), filepath.Join(dir, "bucket")} {
+			info, err := os.Stat(d)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)), d)
+		}
+
+		By("leaving the parents of the workspace as they are")
+		info, err := os.Stat(root)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+	})
+
+	It("Should keep the content of an existing workspace", func() {
+		dir, err := manager.Create(instance)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(dir, "instance", ".terraform"), 0755)).To(Succeed())
+
+		_, err = manager.Create(instance)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Join(dir, "instance", ".terraform")).Should(BeADirectory())
+	})
+
+	It("Should give distinct workspaces to distinct PostgreSqls", func() {
+		dir1, err := manager.Create(instance)
+		Expect(err).ToNot(HaveOccurred())
+		dir2, err := manager.Create(types.NamespacedName{Namespace: "demo_my", Name: "instance"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dir1).ToNot(Equal(dir2))
+	})
+
+	It("Should refuse an incomplete name", func() {
+		_, err := manager.Create(types.NamespacedName{Name: "my-instance"})
+		Expect(err).To(HaveOccurred())
+		Expect(manager.Remove(types.NamespacedName{Namespace: "demo"})).ToNot(Succeed())
+		Expect(root).Should(BeADirectory())
+	})
+
+	It("Should remove the workspace", func() {
+		dir, err := manager.Create(instance)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manager.Remove(instance)).To(Succeed())
+		Expect(dir).ShouldNot(BeADirectory())
+		Expect(manager.List()).To(BeEmpty())
+	})
+
+	It("Should remove the workspaces of deleted PostgreSqls only", func() {
+		deleted := types.NamespacedName{Namespace: "other", Name: "deleted-instance"}
+		for _, key := range []types.NamespacedName{instance, deleted} {
+			_, err := manager.Create(key)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		removed, err := manager.GarbageCollect(func(key types.NamespacedName) (bool, error) {
+			return key == instance, nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(Equal([]types.NamespacedName{deleted}))
+		Expect(manager.List()).To(Equal([]types.NamespacedName{instance}))
+	})
+})